@@ -0,0 +1,297 @@
+package main
+
+// swarm-dns-sd
+// Copyright (C) 2020 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/docker/docker/client"
+	"github.com/docker/go-connections/tlsconfig"
+	"github.com/sirupsen/logrus"
+
+	"github.com/faryon93/kallax/store"
+)
+
+// ---------------------------------------------------------------------------------------
+//  global variables
+// ---------------------------------------------------------------------------------------
+
+var (
+	// cluster names are used as component of DNS names
+	reClusterName = regexp.MustCompile("^[A-Za-z0-9_-]{1,63}$")
+)
+
+// ---------------------------------------------------------------------------------------
+//  types
+// ---------------------------------------------------------------------------------------
+
+// Cluster is a swarm cluster, which is federated with other clusters.
+type Cluster struct {
+	Name string
+	Host string
+}
+
+// DockerTls holds the TLS client configuration of a docker host.
+// Without a CA file the system's root certificates are used.
+type DockerTls struct {
+	CaFile   string
+	CertFile string
+	KeyFile  string
+	Verify   bool
+}
+
+// ---------------------------------------------------------------------------------------
+//  public functions
+// ---------------------------------------------------------------------------------------
+
+// ParseBackends parses a comma separated list of modes and constructs a
+// backend for each of them. The swarm mode yields a backend for each of
+// the clusters, if any are given.
+func ParseBackends(str string, clusters []*Cluster) ([]*store.Backend, error) {
+	backends := make([]*store.Backend, 0)
+	seen := make(map[string]bool)
+
+	for _, mode := range strings.Split(str, ",") {
+		mode = strings.TrimSpace(mode)
+		if mode == "" {
+			continue
+		}
+
+		if seen[mode] {
+			return nil, fmt.Errorf("mode \"%s\" is given twice", mode)
+		}
+		seen[mode] = true
+
+		if mode == ModeSwarm && len(clusters) > 0 {
+			for _, cluster := range clusters {
+				s, err := NewClusterStore(cluster)
+				if err != nil {
+					return nil, fmt.Errorf("failed to create store of cluster \"%s\": %w", cluster.Name, err)
+				}
+				backends = append(backends, &store.Backend{Name: cluster.Name, Store: s})
+			}
+			continue
+		}
+
+		s, err := NewBackendStore(mode)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create %s store: %w", mode, err)
+		}
+		backends = append(backends, &store.Backend{Name: mode, Store: s})
+	}
+
+	if len(backends) < 1 {
+		return nil, fmt.Errorf("at least one mode is required")
+	}
+
+	if len(clusters) > 0 && !seen[ModeSwarm] {
+		return nil, fmt.Errorf("clusters require the %s mode", ModeSwarm)
+	}
+
+	// the backends are distinguished by name
+	names := make(map[string]bool)
+	for _, backend := range backends {
+		if names[backend.Name] {
+			return nil, fmt.Errorf("cluster \"%s\" has the name of a mode", backend.Name)
+		}
+		names[backend.Name] = true
+	}
+
+	return backends, nil
+}
+
+// ParseClusters parses a comma separated list of swarm clusters: name=host
+func ParseClusters(str string) ([]*Cluster, error) {
+	clusters := make([]*Cluster, 0)
+	seen := make(map[string]bool)
+
+	for _, cluster := range strings.Split(str, ",") {
+		cluster = strings.TrimSpace(cluster)
+		if cluster == "" {
+			continue
+		}
+
+		parts := strings.SplitN(cluster, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, fmt.Errorf("cluster \"%s\" is not of the form name=host", cluster)
+		}
+
+		name := strings.ToLower(parts[0])
+		if !reClusterName.MatchString(name) {
+			return nil, fmt.Errorf("cluster name \"%s\" is not a valid DNS label", parts[0])
+		}
+
+		if seen[name] {
+			return nil, fmt.Errorf("cluster \"%s\" is given twice", name)
+		}
+		seen[name] = true
+
+		clusters = append(clusters, &Cluster{Name: name, Host: parts[1]})
+	}
+
+	return clusters, nil
+}
+
+// NewBackendStore constructs the store of a mode.
+func NewBackendStore(mode string) (store.Store, error) {
+	tls, err := DockerTlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	ops, err := DockerOpts(DockerHost, tls)
+	if err != nil {
+		return nil, err
+	}
+
+	switch mode {
+	case ModeSwarm:
+		s, err := store.NewDocker(Resync, ops...)
+		if err == nil {
+			logrus.Infoln("connected to docker swarm on", DockerHost)
+		}
+		return s, err
+
+	case ModeContainer:
+		s, err := store.NewContainer(Resync, ops...)
+		if err == nil {
+			logrus.Infoln("connected to docker on", DockerHost)
+		}
+		return s, err
+
+	case ModeStatic:
+		s, err := store.NewStatic(StaticFile)
+		if err == nil {
+			logrus.Infoln("serving static endpoints from", StaticFile)
+		}
+		return s, err
+	}
+
+	return nil, fmt.Errorf("unknown mode \"%s\"", mode)
+}
+
+// NewClusterStore constructs the swarm store of a cluster. The cluster is
+// synced in the background if it is unreachable, so that the other
+// clusters can still be served.
+func NewClusterStore(cluster *Cluster) (store.Store, error) {
+	// the certificates of the cluster are optional
+	var tls *DockerTls
+	if ClusterCerts != "" {
+		path := filepath.Join(ClusterCerts, cluster.Name)
+		if _, err := os.Stat(path); err == nil {
+			tls = certPathTls(path, true)
+		}
+	}
+
+	ops, err := DockerOpts(cluster.Host, tls)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := store.NewDockerCluster(cluster.Name, Resync, ops...)
+	if err == nil {
+		logrus.Infof("federating docker swarm \"%s\" on %s", cluster.Name, cluster.Host)
+	}
+
+	return s, err
+}
+
+// DockerTlsConfig returns the TLS client configuration of the docker host
+// given by the flags, or by the environment variables DOCKER_CERT_PATH and
+// DOCKER_TLS_VERIFY like the docker CLI. It is nil if TLS is not configured.
+func DockerTlsConfig() (*DockerTls, error) {
+	if (TlsCert == "") != (TlsKey == "") {
+		return nil, fmt.Errorf("the client certificate and key must be given together")
+	}
+
+	if TlsCa != "" || TlsCert != "" {
+		return &DockerTls{CaFile: TlsCa, CertFile: TlsCert, KeyFile: TlsKey, Verify: true}, nil
+	}
+
+	if certPath := os.Getenv("DOCKER_CERT_PATH"); certPath != "" {
+		return certPathTls(certPath, os.Getenv("DOCKER_TLS_VERIFY") != ""), nil
+	}
+
+	return nil, nil
+}
+
+// DockerOpts returns the options of a docker client connecting to the host.
+// TLS is used if the configuration is not nil. Connecting to the host and
+// the TLS handshake time out after DockerTimeout.
+func DockerOpts(host string, tls *DockerTls) ([]client.Opt, error) {
+	hostUrl, err := client.ParseHostURL(host)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := &http.Transport{TLSHandshakeTimeout: DockerTimeout}
+	if tls != nil {
+		transport.TLSClientConfig, err = tlsconfig.Client(tlsconfig.Options{
+			CAFile:             tls.CaFile,
+			CertFile:           tls.CertFile,
+			KeyFile:            tls.KeyFile,
+			InsecureSkipVerify: !tls.Verify,
+			ExclusiveRootPools: true,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to load TLS configuration: %w", err)
+		}
+	}
+
+	// the host decides upon the socket to dial, the timeout is applied
+	// to unix sockets as well as to tcp connections
+	dialer := &net.Dialer{Timeout: DockerTimeout}
+	dial := func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		if hostUrl.Scheme == "unix" {
+			return dialer.DialContext(ctx, "unix", hostUrl.Host)
+		}
+		return dialer.DialContext(ctx, network, addr)
+	}
+
+	return []client.Opt{
+		client.WithHTTPClient(&http.Client{Transport: transport, CheckRedirect: client.CheckRedirect}),
+		client.WithHost(host),
+		client.WithDialContext(dial),
+		client.WithAPIVersionNegotiation(),
+	}, nil
+}
+
+// ---------------------------------------------------------------------------------------
+//  private functions
+// ---------------------------------------------------------------------------------------
+
+// certPathTls returns the TLS configuration of a directory, which holds
+// the files ca.pem, cert.pem and key.pem.
+func certPathTls(path string, verify bool) *DockerTls {
+	return &DockerTls{
+		CaFile:   filepath.Join(path, "ca.pem"),
+		CertFile: filepath.Join(path, "cert.pem"),
+		KeyFile:  filepath.Join(path, "key.pem"),
+		Verify:   verify,
+	}
+}
@@ -0,0 +1,519 @@
+package main
+
+// swarm-dns-sd
+// Copyright (C) 2020 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+
+	"github.com/faryon93/kallax/store"
+)
+
+// ---------------------------------------------------------------------------------------
+//  global variables
+// ---------------------------------------------------------------------------------------
+
+var (
+	// errNotInZone is returned for names we are not authoritative for
+	errNotInZone = errors.New("not within zone")
+)
+
+// ---------------------------------------------------------------------------------------
+//  public functions
+// ---------------------------------------------------------------------------------------
+
+// MakeAddressRRs constructs the A or AAAA records of a name.
+// All other query types yield no records.
+func MakeAddressRRs(name string, qtype uint16, ttl uint, addrs *store.Addresses) ([]dns.RR, error) {
+	var ips []net.IP
+	switch qtype {
+	case dns.TypeA:
+		ips = addrs.IPv4
+	case dns.TypeAAAA:
+		ips = addrs.IPv6
+	}
+
+	rrs := make([]dns.RR, 0, len(ips))
+	for _, ip := range ips {
+		// TTL IN A|AAAA address
+		rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s",
+			name, ttl, dns.TypeToString[qtype], ip))
+		if err != nil {
+			return nil, err
+		}
+		rrs = append(rrs, rr)
+	}
+
+	return rrs, nil
+}
+
+// MakeTxtRR constructs the TXT record of an endpoint, which carries
+// the metadata as "key=value" strings as described by RFC 6763.
+func MakeTxtRR(name string, ep *store.Endpoint) dns.RR {
+	keys := make([]string, 0, len(ep.Meta))
+	for key := range ep.Meta {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	// a TXT record without metadata holds a single empty string
+	txt := make([]string, 0, len(keys))
+	for _, key := range keys {
+		txt = append(txt, key+"="+ep.Meta[key])
+	}
+	if len(txt) < 1 {
+		txt = append(txt, "")
+	}
+
+	// the record is not parsed from a string to avoid quoting issues
+	return &dns.TXT{
+		Hdr: dns.RR_Header{
+			Name:   name,
+			Rrtype: dns.TypeTXT,
+			Class:  dns.ClassINET,
+			Ttl:    uint32(ttlOrDefault(ep.Ttl, TtlTxt)),
+		},
+		Txt: txt,
+	}
+}
+
+// RefuseDNS answers queries for names outside of all served zones with
+// REFUSED, so resolvers do not mistake them for a failure of the server.
+func RefuseDNS(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetRcode(r, dns.RcodeRefused)
+
+	err := w.WriteMsg(m)
+	if err != nil {
+		logrus.Error("failed to write dns response:", err.Error())
+	}
+}
+
+// ---------------------------------------------------------------------------------------
+//  public members
+// ---------------------------------------------------------------------------------------
+
+func (z *Zone) MakeSrvRRFromEndpoint(q *dns.Question, ep *store.Endpoint) (dns.RR, error) {
+	// TTL IN SRV priority weight port target
+	return dns.NewRR(fmt.Sprintf("%s %d IN SRV %d %d %d %s",
+		q.Name, ttlOrDefault(ep.Ttl, TtlSrv), ep.Priority, ep.Weight,
+		ep.Port, z.Fqdn(ep.Name)))
+}
+
+// MakeSoaRR constructs the SOA record of the zone, which
+// is also used by resolvers for negative caching. The serial
+// is incremented whenever the content of the store changes.
+func (z *Zone) MakeSoaRR() (dns.RR, error) {
+	serial := soaSerialBase + uint32(Store.GetRevision())
+
+	// TTL IN SOA mname rname serial refresh retry expire minimum
+	return dns.NewRR(fmt.Sprintf("%s %d IN SOA %s %s %d 3600 600 86400 %d",
+		z.Name, TtlZone, z.NameServers[0].Name, z.Hostmaster, serial, TtlNegative))
+}
+
+// MakeNsRRs constructs the NS records of the zone.
+func (z *Zone) MakeNsRRs() ([]dns.RR, error) {
+	rrs := make([]dns.RR, 0, len(z.NameServers))
+	for _, ns := range z.NameServers {
+		// TTL IN NS host
+		rr, err := dns.NewRR(fmt.Sprintf("%s %d IN NS %s", z.Name, TtlZone, ns.Name))
+		if err != nil {
+			return nil, err
+		}
+		rrs = append(rrs, rr)
+	}
+
+	return rrs, nil
+}
+
+// ServeDNS answers a query for a name within the zone.
+func (z *Zone) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+	m.Compress = false
+
+	// the response must fit into the buffer size negotiated with the client
+	maxSize := maxResponseSize(w, r)
+	if r.IsEdns0() != nil {
+		m.SetEdns0(uint16(EdnsBufferSize), false)
+	}
+
+	switch {
+	// only handle DNS Queries
+	case r.Opcode != dns.OpcodeQuery:
+		m.SetRcode(r, dns.RcodeNotImplemented)
+
+	// a query carries exactly one question in practice
+	case len(r.Question) != 1:
+		m.SetRcode(r, dns.RcodeFormatError)
+
+	default:
+		q := r.Question[0]
+		logrus.Debugf("Query for \"%s\" (%d)", q.Name, q.Qtype)
+
+		glue, err := z.answerQuestion(m, &q)
+		if errors.Is(err, errNotInZone) {
+			m.Authoritative = false
+			m.Rcode = dns.RcodeRefused
+		} else if errors.Is(err, store.ErrNotFound) {
+			m.Rcode = dns.RcodeNameError
+		} else if err != nil {
+			logrus.Errorf("failed to answer query for \"%s\": %s", q.Name, err.Error())
+			m.Rcode = dns.RcodeServerFailure
+		}
+
+		// negative answers carry the SOA in the authority section
+		if len(m.Answer) < 1 && (m.Rcode == dns.RcodeSuccess || m.Rcode == dns.RcodeNameError) {
+			soa, err := z.MakeSoaRR()
+			if err != nil {
+				logrus.Errorln("failed to construct DNS SOA-RR:", err.Error())
+			} else {
+				m.Ns = append(m.Ns, soa)
+			}
+		}
+
+		// the additional section is optional, hence only
+		// the glue records which fit into the response are added
+		for _, rrs := range glue {
+			m.Extra = append(m.Extra, rrs...)
+			if m.Len() > maxSize {
+				m.Extra = m.Extra[:len(m.Extra)-len(rrs)]
+				break
+			}
+		}
+	}
+
+	// answers which do not fit are truncated and the TC bit is
+	// set in order to make the client retry the query via TCP
+	m.Truncate(maxSize)
+	if m.Truncated {
+		logrus.Debugf("truncated response to %d bytes", maxSize)
+	}
+
+	err := w.WriteMsg(m)
+	if err != nil {
+		logrus.Error("failed to write dns response:", err.Error())
+	}
+}
+
+// ---------------------------------------------------------------------------------------
+//  private members
+// ---------------------------------------------------------------------------------------
+
+// answerQuestion fills the answer section of m. The glue records
+// of SRV targets are returned grouped by target. An error wrapping
+// store.ErrNotFound is returned if the queried name does not exist,
+// one wrapping errNotInZone if it is not within the zone.
+func (z *Zone) answerQuestion(m *dns.Msg, q *dns.Question) ([][]dns.RR, error) {
+	name, ok := z.RelativeName(q.Name)
+	if !ok {
+		return nil, fmt.Errorf("%w: \"%s\" is not within zone \"%s\"",
+			errNotInZone, q.Name, z.Name)
+	}
+
+	// names in DNS are case-insensitive, the stores
+	// serve the groups and endpoints in lower case
+	name = strings.ToLower(name)
+
+	// the zone apex holds the SOA and NS records
+	if name == "" {
+		// the apex of the reverse zone of a single address
+		// is the address itself, which holds the PTR records
+		if z.Subnet != nil && q.Qtype == dns.TypePTR {
+			err := z.answerReverse(m, q, name)
+			if errors.Is(err, store.ErrNotFound) {
+				return nil, nil
+			}
+			return nil, err
+		}
+
+		return z.answerApex(m, q)
+	}
+
+	// reverse zones map addresses to endpoint names
+	if z.Subnet != nil {
+		return nil, z.answerReverse(m, q, name)
+	}
+
+	// endpoint names resolve to the addresses of a task
+	// or the virtual IP of a service
+	if reEndpointName.MatchString(name) || reVipName.MatchString(name) {
+		addrs, err := lookupEndpointAddresses(name)
+		if err != nil {
+			return nil, err
+		}
+
+		if q.Qtype == dns.TypeTXT {
+			return nil, answerTxt(m, q, name)
+		}
+
+		rrs, err := MakeAddressRRs(q.Name, q.Qtype, ttlOrDefault(addrs.Ttl, TtlAddress), addrs)
+		if err != nil {
+			return nil, err
+		}
+		m.Answer = append(m.Answer, rrs...)
+		logrus.Debugf("%v %v", addrs.IPv4, addrs.IPv6)
+
+		return nil, nil
+	}
+
+	// name servers within the zone resolve to their addresses
+	for _, ns := range z.NameServers {
+		if strings.EqualFold(q.Name, ns.Name) {
+			rrs, err := MakeAddressRRs(q.Name, q.Qtype, TtlZone, &ns.Addrs)
+			if err != nil {
+				return nil, err
+			}
+			m.Answer = append(m.Answer, rrs...)
+
+			return nil, nil
+		}
+	}
+
+	// all other names are group names
+	eps, err := lookupGroupEndpoints(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if q.Qtype != dns.TypeSRV {
+		return nil, nil
+	}
+
+	glue := make([][]dns.RR, 0, len(eps))
+	for _, ep := range eps {
+		rr, err := z.MakeSrvRRFromEndpoint(q, ep)
+		if err != nil {
+			return nil, err
+		}
+		m.Answer = append(m.Answer, rr)
+
+		// glue records of the target
+		rrs, err := makeGlueRRs(rr.(*dns.SRV).Target, ep.Name)
+		if err != nil {
+			logrus.Errorln("failed to construct glue records:", err.Error())
+		} else {
+			glue = append(glue, rrs)
+		}
+
+		logrus.Debugf("%s:%d", ep.Name, ep.Port)
+	}
+
+	return glue, nil
+}
+
+// answerApex fills the answer section of m for the zone apex.
+// The addresses of the name servers are returned as glue records.
+func (z *Zone) answerApex(m *dns.Msg, q *dns.Question) ([][]dns.RR, error) {
+	switch q.Qtype {
+	case dns.TypeSOA:
+		rr, err := z.MakeSoaRR()
+		if err != nil {
+			return nil, err
+		}
+		m.Answer = append(m.Answer, rr)
+
+	case dns.TypeNS:
+		rrs, err := z.MakeNsRRs()
+		if err != nil {
+			return nil, err
+		}
+		m.Answer = append(m.Answer, rrs...)
+
+		glue := make([][]dns.RR, 0, len(z.NameServers))
+		for _, ns := range z.NameServers {
+			nsGlue := make([]dns.RR, 0)
+			for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+				rrs, err := MakeAddressRRs(ns.Name, qtype, TtlZone, &ns.Addrs)
+				if err != nil {
+					return nil, err
+				}
+				nsGlue = append(nsGlue, rrs...)
+			}
+			glue = append(glue, nsGlue)
+		}
+
+		return glue, nil
+	}
+
+	return nil, nil
+}
+
+// answerReverse fills the answer section of m with the PTR records
+// of an address. The endpoint names are qualified with the first zone.
+func (z *Zone) answerReverse(m *dns.Msg, q *dns.Question, name string) error {
+	// names which do not denote a complete address
+	// are empty non-terminals of the reverse zone
+	ip := parseReverseName(z, name)
+	if ip == nil {
+		return nil
+	}
+
+	if !z.Subnet.Contains(ip) {
+		return fmt.Errorf("%w: address \"%s\" is not within subnet \"%s\"",
+			store.ErrNotFound, ip, z.Subnet)
+	}
+
+	eps, err := Store.GetAddressEndpoints(ip)
+	if err != nil {
+		return err
+	}
+
+	if q.Qtype != dns.TypePTR {
+		return nil
+	}
+
+	for _, ep := range eps {
+		// TTL IN PTR name
+		rr, err := dns.NewRR(fmt.Sprintf("%s %d IN PTR %s",
+			q.Name, TtlPtr, Zones[0].Fqdn(ep.Name)))
+		if err != nil {
+			return err
+		}
+		m.Answer = append(m.Answer, rr)
+	}
+
+	return nil
+}
+
+// ---------------------------------------------------------------------------------------
+//  private functions
+// ---------------------------------------------------------------------------------------
+
+// lookupGroupEndpoints returns the endpoints of a group name relative
+// to the zone apex. The name "<group>.<cluster>" is limited to a cluster.
+func lookupGroupEndpoints(name string) ([]*store.Endpoint, error) {
+	parts := strings.SplitN(name, ".", 2)
+	if len(parts) < 2 {
+		return Store.GetGroupEndpoints(name)
+	}
+
+	s, ok := ClusterStores[parts[1]]
+	if !ok {
+		return nil, fmt.Errorf("%w: cluster \"%s\"", store.ErrNotFound, parts[1])
+	}
+
+	return s.GetGroupEndpoints(parts[0])
+}
+
+// lookupEndpointAddresses resolves the addresses of an endpoint
+// or virtual IP name relative to the zone apex.
+func lookupEndpointAddresses(name string) (*store.Addresses, error) {
+	if pp := reVipName.FindStringSubmatch(name); len(pp) > 0 {
+		return Store.GetVirtualIpAddresses(pp[4], pp[2], pp[1], pp[3])
+	}
+
+	pp := reEndpointName.FindStringSubmatch(name)
+	if len(pp) < 1 {
+		return nil, fmt.Errorf("%w: \"%s\" is not an endpoint name",
+			store.ErrNotFound, name)
+	}
+
+	taskId := pp[3]
+	networkId := pp[6]
+	return Store.GetTaskIpAddresses(taskId, networkId)
+}
+
+// answerTxt fills the answer section of m with the TXT record
+// of the endpoint or virtual IP name relative to the zone apex.
+func answerTxt(m *dns.Msg, q *dns.Question, name string) error {
+	var eps []*store.Endpoint
+	var epName, network string
+	var err error
+
+	if pp := reVipName.FindStringSubmatch(name); len(pp) > 0 {
+		epName, network = pp[1], pp[3]
+		eps, err = Store.GetVirtualIpEndpoints(pp[4], pp[2])
+	} else if pp := reEndpointName.FindStringSubmatch(name); len(pp) > 0 {
+		epName, network = pp[1], pp[6]
+		eps, err = Store.GetTaskEndpoints(pp[3])
+	} else {
+		return fmt.Errorf("%w: \"%s\" is not an endpoint name",
+			store.ErrNotFound, name)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, ep := range eps {
+		if ep.SpecName == epName && strings.EqualFold(ep.Network, network) {
+			m.Answer = append(m.Answer, MakeTxtRR(q.Name, ep))
+			break
+		}
+	}
+
+	return nil
+}
+
+// makeGlueRRs constructs the A and AAAA records of a SRV target.
+func makeGlueRRs(target string, endpointName string) ([]dns.RR, error) {
+	addrs, err := lookupEndpointAddresses(endpointName)
+	if err != nil {
+		return nil, err
+	}
+
+	rrs := make([]dns.RR, 0)
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		addrRRs, err := MakeAddressRRs(target, qtype, ttlOrDefault(addrs.Ttl, TtlAddress), addrs)
+		if err != nil {
+			return nil, err
+		}
+		rrs = append(rrs, addrRRs...)
+	}
+
+	return rrs, nil
+}
+
+// ttlOrDefault returns the given TTL, or the default if it is not set.
+func ttlOrDefault(ttl uint32, def uint) uint {
+	if ttl > 0 {
+		return uint(ttl)
+	}
+
+	return def
+}
+
+// maxResponseSize returns the maximum size in bytes of a response
+// to the given request. UDP responses are limited to the buffer size
+// the client has announced via EDNS0, but never exceed our own.
+func maxResponseSize(w dns.ResponseWriter, r *dns.Msg) int {
+	if _, ok := w.RemoteAddr().(*net.TCPAddr); ok {
+		return dns.MaxMsgSize
+	}
+
+	size := dns.MinMsgSize
+	if opt := r.IsEdns0(); opt != nil && opt.UDPSize() > dns.MinMsgSize {
+		size = int(opt.UDPSize())
+	}
+
+	if size > EdnsBufferSize {
+		size = EdnsBufferSize
+	}
+
+	return size
+}
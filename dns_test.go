@@ -0,0 +1,169 @@
+package main
+
+// swarm-dns-sd
+// Copyright (C) 2020 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/faryon93/kallax/store"
+)
+
+// ---------------------------------------------------------------------------------------
+//  types
+// ---------------------------------------------------------------------------------------
+
+// addressStore serves the endpoints of fixed addresses,
+// all other members of the store are not implemented.
+type addressStore struct {
+	store.Store
+	endpoints map[string][]*store.Endpoint
+}
+
+func (s *addressStore) GetAddressEndpoints(ip net.IP) ([]*store.Endpoint, error) {
+	eps, ok := s.endpoints[ip.String()]
+	if !ok {
+		return nil, fmt.Errorf("%w: address \"%s\"", store.ErrNotFound, ip)
+	}
+
+	return eps, nil
+}
+
+// groupStore serves fixed groups and task addresses,
+// all other members of the store are not implemented.
+type groupStore struct {
+	store.Store
+	groups map[string][]*store.Endpoint
+	tasks  map[string]*store.Addresses
+}
+
+func (s *groupStore) GetGroupEndpoints(group string) ([]*store.Endpoint, error) {
+	eps, ok := s.groups[group]
+	if !ok {
+		return nil, fmt.Errorf("%w: group \"%s\"", store.ErrNotFound, group)
+	}
+
+	return eps, nil
+}
+
+func (s *groupStore) GetTaskIpAddresses(taskId string, network string) (*store.Addresses, error) {
+	addrs, ok := s.tasks[taskId+"/"+network]
+	if !ok {
+		return nil, fmt.Errorf("%w: task \"%s\"", store.ErrNotFound, taskId)
+	}
+
+	return addrs, nil
+}
+
+// ---------------------------------------------------------------------------------------
+//  tests
+// ---------------------------------------------------------------------------------------
+
+func TestAnswerReverse(t *testing.T) {
+	zone, err := NewZone(DefaultZone, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	Zones = []*Zone{zone}
+
+	Store = &addressStore{endpoints: map[string][]*store.Endpoint{
+		"10.1.2.3": {{Name: "http.task-1-abc.web.node1.prom"}},
+		"fd00::1":  {{Name: "http.task-2-def.web.node1.prom"}},
+	}}
+
+	tests := []struct {
+		subnet string
+		qname  string
+		ptr    string
+	}{
+		{"10.1.2.0/24", "3.2.1.10.in-addr.arpa.", "http.task-1-abc.web.node1.prom.kallax.local."},
+		{"10.1.2.0/24", "4.2.1.10.in-addr.arpa.", ""},
+		{"10.1.2.0/24", "2.1.10.in-addr.arpa.", ""},
+		{"10.1.2.3/32", "3.2.1.10.in-addr.arpa.", "http.task-1-abc.web.node1.prom.kallax.local."},
+		{"10.1.2.4/32", "4.2.1.10.in-addr.arpa.", ""},
+		{"fd00::1/128", "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa.",
+			"http.task-2-def.web.node1.prom.kallax.local."},
+	}
+
+	for _, test := range tests {
+		zones, err := ParseReverseZones(test.subnet, zone.NameServers, zone.Hostmaster)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		m := new(dns.Msg)
+		q := dns.Question{Name: test.qname, Qtype: dns.TypePTR, Qclass: dns.ClassINET}
+		_, err = zones[0].answerQuestion(m, &q)
+		if test.ptr == "" {
+			if len(m.Answer) > 0 {
+				t.Errorf("%s in %s: expected no answer, got %v", test.qname, test.subnet, m.Answer)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s in %s: %s", test.qname, test.subnet, err.Error())
+		} else if len(m.Answer) != 1 || m.Answer[0].(*dns.PTR).Ptr != test.ptr {
+			t.Errorf("%s in %s: expected PTR %s, got %v", test.qname, test.subnet, test.ptr, m.Answer)
+		}
+	}
+}
+
+func TestAnswerQuestionCase(t *testing.T) {
+	zone, err := NewZone(DefaultZone, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	Zones = []*Zone{zone}
+
+	Store = &groupStore{
+		groups: map[string][]*store.Endpoint{
+			"mon": {{Name: "http.task-1-abc.web.node1.prom", Port: 80}},
+		},
+		tasks: map[string]*store.Addresses{
+			"abc/prom": {IPv4: []net.IP{net.ParseIP("10.1.2.3")}},
+		},
+	}
+
+	tests := []struct {
+		qname string
+		qtype uint16
+	}{
+		{"mon.kallax.local.", dns.TypeSRV},
+		{"MON.kallax.local.", dns.TypeSRV},
+		{"Mon.Kallax.Local.", dns.TypeSRV},
+		{"HTTP.task-1-ABC.web.node1.PROM.kallax.local.", dns.TypeA},
+	}
+
+	for _, test := range tests {
+		m := new(dns.Msg)
+		q := dns.Question{Name: test.qname, Qtype: test.qtype, Qclass: dns.ClassINET}
+		_, err := zone.answerQuestion(m, &q)
+		if err != nil {
+			t.Errorf("%s: %s", test.qname, err.Error())
+		} else if len(m.Answer) != 1 {
+			t.Errorf("%s: expected one answer, got %v", test.qname, m.Answer)
+		}
+	}
+}
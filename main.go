@@ -22,21 +22,22 @@ package main
 
 import (
 	"flag"
-	"fmt"
 	"net/http"
 	"os"
 	"regexp"
-	"strings"
 	"syscall"
+	"time"
 
-	"github.com/docker/docker/client"
 	"github.com/faryon93/util"
 	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 
 	"github.com/faryon93/kallax/dnsadapt"
 	"github.com/faryon93/kallax/metric"
+	"github.com/faryon93/kallax/promsd"
+	"github.com/faryon93/kallax/status"
 	"github.com/faryon93/kallax/store"
 )
 
@@ -45,7 +46,12 @@ import (
 // ---------------------------------------------------------------------------------------
 
 const (
-	BaseDomain = "kallax.local"
+	DefaultZone = "kallax.local"
+
+	// sources of the endpoints
+	ModeSwarm     = "swarm"
+	ModeContainer = "container"
+	ModeStatic    = "static"
 )
 
 // ---------------------------------------------------------------------------------------
@@ -56,102 +62,91 @@ var (
 	Colors     bool
 	Debug	   bool
 	DockerHost string
+	Mode       string
+	StaticFile string
+	Resync     time.Duration
 	DnsListen  string
 	PromListen string
 
-	Store store.Store
+	EdnsBufferSize int
 
-	reEndpointName = regexp.MustCompile("([A-Za-z0-9_-]+)\\.task-(\\d+)-([A-Za-z0-9_-]+)\\.([A-Za-z0-9_-]+)\\.([A-Za-z0-9_-]+)\\.([A-Za-z0-9_-]+)\\.kallax\\.local")
-)
+	FileSdDir    string
+	FileSdFormat string
 
-// ---------------------------------------------------------------------------------------
-//  private functions
-// ---------------------------------------------------------------------------------------
+	// TLS client configuration of the docker host
+	TlsCa         string
+	TlsCert       string
+	TlsKey        string
+	DockerTimeout time.Duration
 
-func MakeSrvRRFromEndpoint(q *dns.Question, ep *store.Endpoint) (dns.RR, error) {
-	// TTL IN SRV priority weight port target
-	return dns.NewRR(fmt.Sprintf("%s 15 IN SRV 10 0 %d %s.%s.",
-		q.Name, ep.Port, ep.Name, BaseDomain))
-}
+	// directory of the TLS certificates of the clusters
+	ClusterCerts string
 
-func handleDnsQuery(w dns.ResponseWriter, r *dns.Msg) {
-	// only handle DNS Queries
-	if r.Opcode != dns.OpcodeQuery {
-		return
-	}
+	// default TTLs in seconds
+	TtlSrv      uint
+	TtlAddress  uint
+	TtlZone     uint
+	TtlNegative uint
+	TtlPtr      uint
+	TtlTxt      uint
 
-	// parse and handle the query
-	m := new(dns.Msg)
-	m.SetReply(r)
-	m.Compress = false
-
-	// answer all questions if possible
-	for _, q := range m.Question {
-		logrus.Debugf("Query for \"%s\" (%d)", q.Name, q.Qtype)
-
-		switch q.Qtype {
-		case dns.TypeA:
-			// TODO: sanitize input
-			pp := reEndpointName.FindStringSubmatch(q.Name)
-			if len(pp) < 1 {
-				return
-			}
+	Store        store.Store
+	Zones        []*Zone
+	ReverseZones []*Zone
 
-			taskId := pp[3]
-			networkId := pp[6]
-			addr, err := Store.GetTaskIpAddresses(taskId, networkId)
-			if err != nil {
-				logrus.Errorln("failed to get task ip addresses:", err.Error())
-				return
-			}
+	// stores of the federated clusters by name
+	ClusterStores = make(map[string]store.Store)
 
-			record := fmt.Sprintf("%s 15 IN A %s", q.Name, addr)
-			rr, err := dns.NewRR(record)
-			if err != nil {
-				logrus.Error("failed to construct DNS A-RR:", err.Error())
-				continue
-			}
-			m.Answer = append(m.Answer, rr)
-			logrus.Debugf("%s", addr)
-
-		case dns.TypeSRV:
-			// TODO: sanitize input
-			groupName := strings.TrimRight(q.Name, BaseDomain+".")
-			eps, err := Store.GetGroupEndpoints(groupName)
-			if err != nil {
-				logrus.Errorln("failed to query group endpoints:", err.Error())
-				return
-			}
-
-			for _, ep := range eps {
-				rr, err := MakeSrvRRFromEndpoint(&q, ep)
-				if err != nil {
-					logrus.Error("failed to construct DNS SRV-RR:", err.Error())
-					continue
-				}
-				m.Answer = append(m.Answer, rr)
-
-				logrus.Debugf("%s:%d", ep.Name, ep.Port)
-			}
-		}
-	}
+	// the SOA serial continues to increase across restarts
+	soaSerialBase = uint32(time.Now().Unix())
 
-	err := w.WriteMsg(m)
-	if err != nil {
-		logrus.Error("failed to write dns response:", err.Error())
-	}
-}
+	// endpoint names relative to the zone apex
+	reEndpointName = regexp.MustCompile("^([A-Za-z0-9_-]+)\\.task-(\\d+)-([A-Za-z0-9_-]+)\\.([A-Za-z0-9_-]+)\\.([A-Za-z0-9_-]+)\\.([A-Za-z0-9_-]+)$")
+	reVipName      = regexp.MustCompile("^([A-Za-z0-9_-]+)\\.([A-Za-z0-9_-]+)\\.([A-Za-z0-9_-]+)(?:\\.([A-Za-z0-9_-]+))?\\.vip$")
+)
 
 // ---------------------------------------------------------------------------------------
 //  application entry
 // ---------------------------------------------------------------------------------------
 
 func main() {
+	// subcommands have their own flags
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "validate":
+			os.Exit(Validate(os.Args[2:]))
+		case "query":
+			os.Exit(Query(os.Args[2:]))
+		}
+	}
+
 	flag.BoolVar(&Colors, "color", false, "force color logging")
 	flag.BoolVar(&Debug, "debug", false, "turn on debug log")
 	flag.StringVar(&DockerHost, "docker", "unix:///var/run/docker.sock", "docker host")
-	flag.StringVar(&DnsListen, "dns-listen", ":5353", "dns udp listen")
+	flag.StringVar(&TlsCa, "tls-ca", "", "CA certificate to verify the docker host (default \"$DOCKER_CERT_PATH/ca.pem\")")
+	flag.StringVar(&TlsCert, "tls-cert", "", "client certificate to authenticate at the docker host (default \"$DOCKER_CERT_PATH/cert.pem\")")
+	flag.StringVar(&TlsKey, "tls-key", "", "private key of the client certificate (default \"$DOCKER_CERT_PATH/key.pem\")")
+	flag.DurationVar(&DockerTimeout, "docker-timeout", 10*time.Second, "timeout of connecting to docker, including the TLS handshake")
+	flag.StringVar(&Mode, "mode", ModeSwarm, "comma separated sources of the endpoints: swarm, container, static")
+	flag.StringVar(&StaticFile, "static-file", "", "yaml or json file listing the endpoints in static mode")
+	flag.StringVar(&ClusterCerts, "cluster-certs", "", "directory holding the TLS certificates of each cluster in <dir>/<name>")
+	flag.DurationVar(&Resync, "resync", 60*time.Second, "interval of full docker state resyncs")
+	flag.StringVar(&DnsListen, "dns-listen", ":5353", "dns udp and tcp listen")
+	flag.IntVar(&EdnsBufferSize, "edns-size", 1232, "maximum udp payload size negotiated via edns0")
 	flag.StringVar(&PromListen, "prom-listen", ":9800", "prometheus http listen")
+	flag.UintVar(&TtlSrv, "ttl-srv", 15, "default ttl of SRV records")
+	flag.UintVar(&TtlAddress, "ttl-address", 15, "default ttl of A and AAAA records")
+	flag.UintVar(&TtlZone, "ttl-zone", 15, "ttl of SOA and NS records")
+	flag.UintVar(&TtlNegative, "ttl-negative", 15, "ttl of negative answers")
+	flag.UintVar(&TtlPtr, "ttl-ptr", 15, "ttl of PTR records")
+	flag.UintVar(&TtlTxt, "ttl-txt", 15, "default ttl of TXT records")
+	flag.StringVar(&FileSdDir, "file-sd", "", "directory to write prometheus file_sd files to")
+	flag.StringVar(&FileSdFormat, "file-sd-format", promsd.FormatJson, "format of the file_sd files: json, yaml")
+	zones := flag.String("zone", DefaultZone, "comma separated zones to serve")
+	nameServers := flag.String("ns", "", "comma separated name servers of the zones: host[=ip] (default \"ns.<zone>\")")
+	reverse := flag.String("reverse", "", "comma separated subnets to serve reverse zones for")
+	hostmaster := flag.String("hostmaster", "", "mailbox of the zone administrator (default \"hostmaster.<zone>\")")
+	clusters := flag.String("clusters", "", "comma separated swarm clusters to federate in swarm mode: name=host")
 	flag.Parse()
 
 	// setup logger
@@ -163,19 +158,83 @@ func main() {
 	}
 	logrus.Infoln("starting", GetAppVersion())
 
-	var err error
-	Store, err = store.NewDocker(client.WithHost(DockerHost), client.WithAPIVersionNegotiation())
+	if Resync <= 0 {
+		logrus.Errorf("invalid resync interval %s: must be positive", Resync)
+		os.Exit(-1)
+	}
+
+	if EdnsBufferSize < dns.MinMsgSize || EdnsBufferSize > dns.MaxMsgSize {
+		logrus.Errorf("invalid edns buffer size %d: must be within %d-%d",
+			EdnsBufferSize, dns.MinMsgSize, dns.MaxMsgSize)
+		os.Exit(-1)
+	}
+
+	ns, err := ParseNameServers(*nameServers)
 	if err != nil {
-		logrus.Errorln("failed to create docker swarm store:", err.Error())
+		logrus.Errorln("failed to parse name servers:", err.Error())
 		os.Exit(-1)
 	}
-	logrus.Infoln("connected to docker on", DockerHost)
 
-	// start prometheus metrics endpoint
+	Zones, err = ParseZones(*zones, ns, *hostmaster)
+	if err != nil {
+		logrus.Errorln("failed to parse zones:", err.Error())
+		os.Exit(-1)
+	}
+
+	// reverse zones are administered like the first forward zone
+	ReverseZones, err = ParseReverseZones(*reverse, Zones[0].NameServers, Zones[0].Hostmaster)
+	if err != nil {
+		logrus.Errorln("failed to parse reverse zones:", err.Error())
+		os.Exit(-1)
+	}
+
+	federated, err := ParseClusters(*clusters)
+	if err != nil {
+		logrus.Errorln("failed to parse clusters:", err.Error())
+		os.Exit(-1)
+	}
+
+	backends, err := ParseBackends(Mode, federated)
+	if err != nil {
+		logrus.Errorln(err.Error())
+		os.Exit(-1)
+	}
+
+	// the clusters can be queried on their own
+	for _, cluster := range federated {
+		for _, backend := range backends {
+			if backend.Name == cluster.Name {
+				ClusterStores[cluster.Name] = backend.Store
+			}
+		}
+	}
+
+	// multiple backends are merged
+	Store = backends[0].Store
+	if len(backends) > 1 {
+		Store = store.NewComposite(backends...)
+	}
+	prometheus.MustRegister(status.NewCollector(Store))
+
+	// keep the prometheus file_sd files up to date
+	if FileSdDir != "" {
+		writer, err := promsd.NewWriter(Store, FileSdDir, FileSdFormat)
+		if err != nil {
+			logrus.Errorln("failed to create file_sd writer:", err.Error())
+			os.Exit(-1)
+		}
+
+		logrus.Infoln("writing \"file-sd\" to", FileSdDir)
+		go writer.Run(time.Second)
+	}
+
+	// start prometheus metrics and http service discovery endpoint
 	if PromListen != "" {
 		go func() {
 			logrus.Infoln("listening \"prom-metrics\" on", PromListen)
 			http.Handle("/metrics", promhttp.Handler())
+			http.Handle("/sd/prometheus/", promsd.Handler(Store))
+			http.Handle("/status", status.Handler(Store))
 			err := http.ListenAndServe(PromListen, nil)
 			if err != nil {
 				logrus.Errorln("metrics endpoint failed:", err.Error())
@@ -183,19 +242,24 @@ func main() {
 		}()
 	}
 
-	// start DNS server
-	server := &dns.Server{Addr: DnsListen, Net: "udp"}
-	go func() {
-		logrus.Infoln("listening \"dns\" on", DnsListen)
-		chain := dnsadapt.ChainFunc(handleDnsQuery, dnsadapt.PromHistogram(metric.ProcessingTime))
-		dns.Handle(BaseDomain+".", chain)
-		err = server.ListenAndServe()
-		if err != nil {
-			logrus.Fatalf("failed to start DNS server: %s\n ", err.Error())
-			os.Exit(-1)
-		}
-	}()
-	defer server.Shutdown()
+	// start DNS servers
+	for _, zone := range append(Zones, ReverseZones...) {
+		logrus.Infof("serving zone \"%s\"", zone.Name)
+		dns.Handle(zone.Name, dnsadapt.Chain(zone, dnsadapt.PromHistogram(metric.ProcessingTime)))
+	}
+	dns.Handle(".", dnsadapt.ChainFunc(RefuseDNS, dnsadapt.PromHistogram(metric.ProcessingTime)))
+	for _, proto := range []string{"udp", "tcp"} {
+		server := &dns.Server{Addr: DnsListen, Net: proto}
+		go func(proto string) {
+			logrus.Infof("listening \"dns/%s\" on %s", proto, DnsListen)
+			err := server.ListenAndServe()
+			if err != nil {
+				logrus.Fatalf("failed to start DNS server: %s\n ", err.Error())
+				os.Exit(-1)
+			}
+		}(proto)
+		defer server.Shutdown()
+	}
 
 	util.WaitSignal(os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
 	logrus.Println("received SIGINT / SIGTERM going to shutdown")
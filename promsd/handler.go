@@ -0,0 +1,70 @@
+package promsd
+
+// swarm-dns-sd
+// Copyright (C) 2020 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/faryon93/kallax/store"
+)
+
+// ---------------------------------------------------------------------------------------
+//  public functions
+// ---------------------------------------------------------------------------------------
+
+// Handler returns a http.Handler serving the target groups of the
+// group named by the last path element in the http_sd_configs format.
+// The handler is meant to be registered with a prefix like "/sd/prometheus/".
+func Handler(s store.Store) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		group := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+		if group == "" {
+			http.Error(w, "group is missing", http.StatusNotFound)
+			return
+		}
+
+		targetGroups, err := GetTargetGroups(s, group)
+		if errors.Is(err, store.ErrNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		} else if err != nil {
+			logrus.Errorf("failed to get target groups of \"%s\": %s", group, err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(targetGroups)
+		if err != nil {
+			logrus.Errorln("failed to write http sd response:", err.Error())
+		}
+	})
+}
@@ -0,0 +1,128 @@
+package promsd
+
+// swarm-dns-sd
+// Copyright (C) 2020 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"net"
+	"regexp"
+	"strconv"
+
+	"github.com/faryon93/kallax/store"
+)
+
+// ---------------------------------------------------------------------------------------
+//  constants
+// ---------------------------------------------------------------------------------------
+
+const (
+	MetaPrefix = "__meta_kallax_"
+)
+
+// ---------------------------------------------------------------------------------------
+//  global variables
+// ---------------------------------------------------------------------------------------
+
+var (
+	reInvalidLabelChars = regexp.MustCompile("[^a-zA-Z0-9_]")
+)
+
+// ---------------------------------------------------------------------------------------
+//  types
+// ---------------------------------------------------------------------------------------
+
+// TargetGroup is a group of targets in the format of
+// the prometheus http_sd_configs and file_sd_configs.
+type TargetGroup struct {
+	Targets []string          `json:"targets" yaml:"targets"`
+	Labels  map[string]string `json:"labels" yaml:"labels"`
+}
+
+// ---------------------------------------------------------------------------------------
+//  public functions
+// ---------------------------------------------------------------------------------------
+
+// GetTargetGroups returns a TargetGroup for each endpoint of the given group.
+// Endpoints without an address on their network are omitted.
+func GetTargetGroups(s store.Store, group string) ([]*TargetGroup, error) {
+	eps, err := s.GetGroupEndpoints(group)
+	if err != nil {
+		return nil, err
+	}
+
+	targetGroups := make([]*TargetGroup, 0, len(eps))
+	for _, ep := range eps {
+		var addrs *store.Addresses
+		if ep.Vip {
+			addrs, err = s.GetVirtualIpAddresses(ep.Cluster, ep.Service, ep.SpecName, ep.Network)
+		} else {
+			addrs, err = s.GetTaskIpAddresses(ep.TaskId, ep.Network)
+		}
+		if err != nil {
+			continue
+		}
+
+		// IPv4 addresses are preferred
+		var ip net.IP
+		if len(addrs.IPv4) > 0 {
+			ip = addrs.IPv4[0]
+		} else if len(addrs.IPv6) > 0 {
+			ip = addrs.IPv6[0]
+		} else {
+			continue
+		}
+
+		targetGroup := &TargetGroup{
+			Targets: []string{net.JoinHostPort(ip.String(), strconv.Itoa(ep.Port))},
+			Labels: map[string]string{
+				MetaPrefix + "group":        group,
+				MetaPrefix + "endpoint":     ep.SpecName,
+				MetaPrefix + "name":         ep.Name,
+				MetaPrefix + "service_name": ep.Service,
+				MetaPrefix + "task_slot":    strconv.Itoa(ep.Slot),
+				MetaPrefix + "task_id":      ep.TaskId,
+				MetaPrefix + "node_name":    ep.Node,
+				MetaPrefix + "network":      ep.Network,
+			},
+		}
+
+		if ep.Cluster != "" {
+			targetGroup.Labels[MetaPrefix+"cluster"] = ep.Cluster
+		}
+
+		for key, value := range ep.Meta {
+			targetGroup.Labels[MetaPrefix+"meta_"+sanitizeLabelName(key)] = value
+		}
+
+		targetGroups = append(targetGroups, targetGroup)
+	}
+
+	return targetGroups, nil
+}
+
+// ---------------------------------------------------------------------------------------
+//  private functions
+// ---------------------------------------------------------------------------------------
+
+// sanitizeLabelName replaces all characters which
+// are invalid in a prometheus label name by "_".
+func sanitizeLabelName(name string) string {
+	return reInvalidLabelChars.ReplaceAllString(name, "_")
+}
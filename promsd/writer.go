@@ -0,0 +1,206 @@
+package promsd
+
+// swarm-dns-sd
+// Copyright (C) 2020 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+
+	"github.com/faryon93/kallax/store"
+)
+
+// ---------------------------------------------------------------------------------------
+//  constants
+// ---------------------------------------------------------------------------------------
+
+const (
+	FormatJson = "json"
+	FormatYaml = "yaml"
+)
+
+// ---------------------------------------------------------------------------------------
+//  types
+// ---------------------------------------------------------------------------------------
+
+// Writer renders the target groups of every group into
+// a file_sd_configs file named after the group.
+type Writer struct {
+	store  store.Store
+	dir    string
+	format string
+
+	// files written by the last run
+	files map[string]bool
+}
+
+// ---------------------------------------------------------------------------------------
+//  public functions
+// ---------------------------------------------------------------------------------------
+
+// NewWriter constructs a new Writer for the target directory.
+// The format is either FormatJson or FormatYaml.
+func NewWriter(s store.Store, dir string, format string) (*Writer, error) {
+	if format != FormatJson && format != FormatYaml {
+		return nil, fmt.Errorf("unsupported file_sd format \"%s\"", format)
+	}
+
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("\"%s\" is not a directory", dir)
+	}
+
+	return &Writer{
+		store:  s,
+		dir:    dir,
+		format: format,
+		files:  make(map[string]bool),
+	}, nil
+}
+
+// ---------------------------------------------------------------------------------------
+//  public members
+// ---------------------------------------------------------------------------------------
+
+// Run writes all files and rewrites them whenever the content
+// of the store changes. The revision of the store is checked
+// every interval. Run never returns.
+func (w *Writer) Run(interval time.Duration) {
+	revision := w.store.GetRevision()
+	err := w.Write()
+	if err != nil {
+		logrus.Errorln("failed to write file_sd files:", err.Error())
+	}
+
+	for range time.Tick(interval) {
+		current := w.store.GetRevision()
+		if current == revision {
+			continue
+		}
+
+		err := w.Write()
+		if err != nil {
+			logrus.Errorln("failed to write file_sd files:", err.Error())
+			continue
+		}
+		revision = current
+	}
+}
+
+// Write renders the target groups of all groups into their files.
+// Files of groups which vanished since the last call are removed.
+func (w *Writer) Write() error {
+	groups, err := w.store.GetGroups()
+	if err != nil {
+		return err
+	}
+
+	files := make(map[string]bool)
+	for _, group := range groups {
+		// group names stem from labels and are not trusted
+		if group == "" || strings.ContainsAny(group, "/\\") || strings.HasPrefix(group, ".") {
+			logrus.Warnf("group \"%s\" is not a valid file name", group)
+			continue
+		}
+
+		targetGroups, err := GetTargetGroups(w.store, group)
+		if err != nil {
+			return err
+		}
+
+		path := filepath.Join(w.dir, group+"."+w.format)
+		err = w.writeFile(path, targetGroups)
+		if err != nil {
+			return err
+		}
+		files[path] = true
+	}
+
+	for path := range w.files {
+		if files[path] {
+			continue
+		}
+
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	w.files = files
+
+	logrus.Debugf("wrote file_sd files of %d groups", len(groups))
+
+	return nil
+}
+
+// ---------------------------------------------------------------------------------------
+//  private members
+// ---------------------------------------------------------------------------------------
+
+// writeFile atomically replaces the file with the encoded target groups,
+// so prometheus never reads a partially written file.
+func (w *Writer) writeFile(path string, targetGroups []*TargetGroup) error {
+	var buf []byte
+	var err error
+	if w.format == FormatYaml {
+		buf, err = yaml.Marshal(targetGroups)
+	} else {
+		buf, err = json.MarshalIndent(targetGroups, "", "  ")
+	}
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(w.dir, ".kallax-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(buf)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+
+	err = tmp.Chmod(0644)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,373 @@
+package main
+
+// swarm-dns-sd
+// Copyright (C) 2020 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/faryon93/kallax/promsd"
+)
+
+// ---------------------------------------------------------------------------------------
+//  types
+// ---------------------------------------------------------------------------------------
+
+// QueryResult is a single address of an endpoint as reported by a running kallax.
+type QueryResult struct {
+	Group    string            `json:"group"`
+	Endpoint string            `json:"endpoint"`
+	Name     string            `json:"name"`
+	Service  string            `json:"service"`
+	Slot     int               `json:"slot"`
+	TaskId   string            `json:"task_id"`
+	Node     string            `json:"node"`
+	Network  string            `json:"network"`
+	Cluster  string            `json:"cluster,omitempty"`
+	Address  string            `json:"address"`
+	Port     int               `json:"port"`
+	Priority uint16            `json:"priority,omitempty"`
+	Weight   uint16            `json:"weight,omitempty"`
+	Meta     map[string]string `json:"meta,omitempty"`
+}
+
+// ---------------------------------------------------------------------------------------
+//  public functions
+// ---------------------------------------------------------------------------------------
+
+// Query resolves the endpoints of groups via DNS or the
+// http service discovery of a running kallax and returns the exit code.
+func Query(args []string) int {
+	flags := flag.NewFlagSet("query", flag.ExitOnError)
+	server := flags.String("server", "127.0.0.1:5353", "address of the kallax dns server")
+	zone := flags.String("zone", DefaultZone, "zone the groups are served in")
+	tcp := flags.Bool("tcp", false, "query the dns server via tcp")
+	httpUrl := flags.String("http", "", "query the http service discovery instead of dns, e.g. http://127.0.0.1:9800")
+	timeout := flags.Duration("timeout", 5*time.Second, "timeout of a single query")
+	asJson := flags.Bool("json", false, "print the results as JSON")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: kallax query [flags] <group> ...")
+		fmt.Fprintln(flags.Output(), "resolves the endpoints of groups served by a running kallax")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	if flags.NArg() < 1 {
+		flags.Usage()
+		return 2
+	}
+
+	failed := false
+	results := make([]*QueryResult, 0)
+	for _, group := range flags.Args() {
+		var groupResults []*QueryResult
+		var err error
+		if *httpUrl != "" {
+			groupResults, err = queryHttp(*httpUrl, group, *timeout)
+		} else {
+			client := &dns.Client{Timeout: *timeout}
+			if *tcp {
+				client.Net = "tcp"
+			}
+			groupResults, err = queryDns(client, *server, dns.Fqdn(*zone), group)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to query group \"%s\": %s\n", group, err.Error())
+			failed = true
+			continue
+		}
+
+		results = append(results, groupResults...)
+	}
+
+	var err error
+	if *asJson {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(results)
+	} else {
+		err = printResults(results)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "failed to print results:", err.Error())
+		failed = true
+	}
+
+	if failed {
+		return 1
+	}
+
+	return 0
+}
+
+// ---------------------------------------------------------------------------------------
+//  private functions
+// ---------------------------------------------------------------------------------------
+
+// queryDns resolves the SRV records of a group and the addresses and
+// metadata of their targets. The addresses are taken from the glue
+// records if present, otherwise they are queried separately.
+func queryDns(client *dns.Client, server string, zone string, group string) ([]*QueryResult, error) {
+	srvs, extra, err := exchange(client, server, group+"."+zone, dns.TypeSRV)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]*QueryResult, 0)
+	for _, rr := range srvs {
+		srv, ok := rr.(*dns.SRV)
+		if !ok {
+			continue
+		}
+
+		template := QueryResult{
+			Group:    group,
+			Name:     srv.Target,
+			Port:     int(srv.Port),
+			Priority: srv.Priority,
+			Weight:   srv.Weight,
+		}
+
+		// the endpoint name carries the task's details
+		if dns.IsSubDomain(zone, srv.Target) {
+			relName := strings.TrimSuffix(srv.Target[:len(srv.Target)-len(zone)], ".")
+			if matches := reEndpointName.FindStringSubmatch(relName); matches != nil {
+				template.Endpoint = matches[1]
+				template.Slot, _ = strconv.Atoi(matches[2])
+				template.TaskId = matches[3]
+				template.Service = matches[4]
+				template.Node = matches[5]
+				template.Network = matches[6]
+			} else if matches := reVipName.FindStringSubmatch(relName); matches != nil {
+				template.Endpoint = matches[1]
+				template.Service = matches[2]
+				template.Network = matches[3]
+				template.Cluster = matches[4]
+			}
+		}
+
+		txts, _, err := exchange(client, server, srv.Target, dns.TypeTXT)
+		if err != nil {
+			return nil, err
+		}
+		for _, rr := range txts {
+			if txt, ok := rr.(*dns.TXT); ok {
+				template.Meta = parseTxtMeta(txt.Txt)
+			}
+		}
+
+		addrs := glueAddresses(extra, srv.Target)
+		if len(addrs) < 1 {
+			for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+				rrs, _, err := exchange(client, server, srv.Target, qtype)
+				if err != nil {
+					return nil, err
+				}
+				addrs = append(addrs, glueAddresses(rrs, srv.Target)...)
+			}
+		}
+
+		for _, addr := range addrs {
+			result := template
+			result.Address = addr
+			results = append(results, &result)
+		}
+	}
+
+	return results, nil
+}
+
+// exchange sends a single query and returns the answer and additional sections.
+// A name which does not exist is an error.
+func exchange(client *dns.Client, server string, name string, qtype uint16) ([]dns.RR, []dns.RR, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(name), qtype)
+	msg.SetEdns0(dns.DefaultMsgSize, false)
+
+	resp, _, err := client.Exchange(msg, server)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// retry truncated responses via tcp
+	if resp.Truncated && client.Net != "tcp" {
+		tcpClient := &dns.Client{Net: "tcp", Timeout: client.Timeout}
+		return exchange(tcpClient, server, name, qtype)
+	}
+
+	if resp.Rcode != dns.RcodeSuccess {
+		return nil, nil, fmt.Errorf("%s %s: %s", dns.TypeToString[qtype], name, dns.RcodeToString[resp.Rcode])
+	}
+
+	return resp.Answer, resp.Extra, nil
+}
+
+// glueAddresses returns the addresses of the A and AAAA records of a name.
+func glueAddresses(rrs []dns.RR, name string) []string {
+	addrs := make([]string, 0)
+	for _, rr := range rrs {
+		if !strings.EqualFold(rr.Header().Name, name) {
+			continue
+		}
+
+		switch record := rr.(type) {
+		case *dns.A:
+			addrs = append(addrs, record.A.String())
+		case *dns.AAAA:
+			addrs = append(addrs, record.AAAA.String())
+		}
+	}
+
+	return addrs
+}
+
+// parseTxtMeta parses the "key=value" strings of a TXT record.
+func parseTxtMeta(txt []string) map[string]string {
+	meta := make(map[string]string)
+	for _, entry := range txt {
+		parts := strings.SplitN(unescapeTxt(entry), "=", 2)
+		if parts[0] == "" || len(parts) < 2 {
+			continue
+		}
+		meta[parts[0]] = parts[1]
+	}
+
+	if len(meta) < 1 {
+		return nil
+	}
+
+	return meta
+}
+
+// unescapeTxt converts a TXT string from the escaped presentation format
+// of the dns package ("\"", "\\" and "\DDD") back to its raw value.
+func unescapeTxt(str string) string {
+	var raw strings.Builder
+	for i := 0; i < len(str); i++ {
+		if str[i] != '\\' || i+1 >= len(str) {
+			raw.WriteByte(str[i])
+			continue
+		}
+
+		if i+3 < len(str) {
+			if code, err := strconv.ParseUint(str[i+1:i+4], 10, 8); err == nil {
+				raw.WriteByte(byte(code))
+				i += 3
+				continue
+			}
+		}
+
+		raw.WriteByte(str[i+1])
+		i++
+	}
+
+	return raw.String()
+}
+
+// queryHttp fetches the target groups of a group from the http service discovery.
+func queryHttp(baseUrl string, group string, timeout time.Duration) ([]*QueryResult, error) {
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Get(strings.TrimSuffix(baseUrl, "/") + "/sd/prometheus/" + group)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("http status %s", resp.Status)
+	}
+
+	var targetGroups []*promsd.TargetGroup
+	err = json.NewDecoder(resp.Body).Decode(&targetGroups)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]*QueryResult, 0)
+	for _, targetGroup := range targetGroups {
+		labels := targetGroup.Labels
+		slot, _ := strconv.Atoi(labels[promsd.MetaPrefix+"task_slot"])
+
+		meta := make(map[string]string)
+		for key, value := range labels {
+			if strings.HasPrefix(key, promsd.MetaPrefix+"meta_") {
+				meta[strings.TrimPrefix(key, promsd.MetaPrefix+"meta_")] = value
+			}
+		}
+		if len(meta) < 1 {
+			meta = nil
+		}
+
+		for _, target := range targetGroup.Targets {
+			host, port, err := net.SplitHostPort(target)
+			if err != nil {
+				return nil, err
+			}
+			portNum, _ := strconv.Atoi(port)
+
+			results = append(results, &QueryResult{
+				Group:    labels[promsd.MetaPrefix+"group"],
+				Endpoint: labels[promsd.MetaPrefix+"endpoint"],
+				Name:     labels[promsd.MetaPrefix+"name"],
+				Service:  labels[promsd.MetaPrefix+"service_name"],
+				Slot:     slot,
+				TaskId:   labels[promsd.MetaPrefix+"task_id"],
+				Node:     labels[promsd.MetaPrefix+"node_name"],
+				Network:  labels[promsd.MetaPrefix+"network"],
+				Cluster:  labels[promsd.MetaPrefix+"cluster"],
+				Address:  host,
+				Port:     portNum,
+				Meta:     meta,
+			})
+		}
+	}
+
+	return results, nil
+}
+
+// printResults prints the results as human-readable table.
+func printResults(results []*QueryResult) error {
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(table, "GROUP\tENDPOINT\tSERVICE\tSLOT\tNODE\tNETWORK\tIP\tPORT\tMETA")
+	for _, r := range results {
+		meta := make([]string, 0, len(r.Meta))
+		for key, value := range r.Meta {
+			meta = append(meta, key+"="+value)
+		}
+		sort.Strings(meta)
+
+		_, _ = fmt.Fprintf(table, "%s\t%s\t%s\t%d\t%s\t%s\t%s\t%d\t%s\n", r.Group, r.Endpoint,
+			r.Service, r.Slot, r.Node, r.Network, r.Address, r.Port, strings.Join(meta, ","))
+	}
+
+	return table.Flush()
+}
@@ -0,0 +1,100 @@
+package status
+
+// swarm-dns-sd
+// Copyright (C) 2020 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+
+	"github.com/faryon93/kallax/metric"
+	"github.com/faryon93/kallax/store"
+)
+
+// ---------------------------------------------------------------------------------------
+//  global variables
+// ---------------------------------------------------------------------------------------
+
+var (
+	descLabelErrors = prometheus.NewDesc(
+		prometheus.BuildFQName(metric.Namespace, "", "label_errors"),
+		"Number of invalid group labels by service, group and severity.",
+		[]string{"service", "group", "severity"}, nil)
+
+	descBackendUp = prometheus.NewDesc(
+		prometheus.BuildFQName(metric.Namespace, "", "backend_up"),
+		"Whether the source of endpoints is healthy.",
+		[]string{"backend"}, nil)
+)
+
+// ---------------------------------------------------------------------------------------
+//  types
+// ---------------------------------------------------------------------------------------
+
+// Collector exports the label errors and backend health of a store.
+// The values are taken from the store on every scrape.
+type Collector struct {
+	store store.Store
+}
+
+// ---------------------------------------------------------------------------------------
+//  public functions
+// ---------------------------------------------------------------------------------------
+
+// NewCollector constructs a new Collector for the given store.
+func NewCollector(s store.Store) *Collector {
+	return &Collector{store: s}
+}
+
+// ---------------------------------------------------------------------------------------
+//  public members
+// ---------------------------------------------------------------------------------------
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- descLabelErrors
+	ch <- descBackendUp
+}
+
+// Collect implements prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	errs, err := c.store.GetLabelErrors()
+	if err != nil {
+		logrus.Errorln("failed to get label errors:", err.Error())
+	}
+
+	counts := make(map[[3]string]float64)
+	for _, err := range errs {
+		counts[[3]string{err.Service, err.Group, severity(err)}]++
+	}
+	for labels, count := range counts {
+		ch <- prometheus.MustNewConstMetric(descLabelErrors, prometheus.GaugeValue,
+			count, labels[0], labels[1], labels[2])
+	}
+
+	for _, health := range c.store.GetHealth() {
+		up := 0.0
+		if health.Healthy {
+			up = 1
+		}
+		ch <- prometheus.MustNewConstMetric(descBackendUp, prometheus.GaugeValue,
+			up, health.Backend)
+	}
+}
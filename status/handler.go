@@ -0,0 +1,151 @@
+package status
+
+// swarm-dns-sd
+// Copyright (C) 2020 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"text/tabwriter"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/faryon93/kallax/store"
+)
+
+// ---------------------------------------------------------------------------------------
+//  types
+// ---------------------------------------------------------------------------------------
+
+// Status is the JSON representation of the status page.
+type Status struct {
+	Backends    []Backend    `json:"backends"`
+	LabelErrors []LabelError `json:"label_errors"`
+}
+
+// Backend is the JSON representation of the health of a source of endpoints.
+type Backend struct {
+	Name    string `json:"name"`
+	Healthy bool   `json:"healthy"`
+	Message string `json:"message"`
+}
+
+// LabelError is the JSON representation of an invalid group label.
+type LabelError struct {
+	Service  string `json:"service"`
+	Group    string `json:"group"`
+	Label    string `json:"label"`
+	Message  string `json:"message"`
+	Severity string `json:"severity"`
+}
+
+// ---------------------------------------------------------------------------------------
+//  public functions
+// ---------------------------------------------------------------------------------------
+
+// Handler returns a http.Handler serving the health of the store's backends
+// and the invalid group labels of all services as plain text tables,
+// or as JSON with the query "?format=json".
+func Handler(s store.Store) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		errs, err := s.GetLabelErrors()
+		if err != nil {
+			logrus.Errorln("failed to get label errors:", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		status := Status{
+			Backends:    make([]Backend, 0),
+			LabelErrors: make([]LabelError, 0, len(errs)),
+		}
+
+		for _, health := range s.GetHealth() {
+			status.Backends = append(status.Backends, Backend{
+				Name:    health.Backend,
+				Healthy: health.Healthy,
+				Message: health.Message,
+			})
+		}
+
+		for _, err := range errs {
+			status.LabelErrors = append(status.LabelErrors, LabelError{
+				Service:  err.Service,
+				Group:    err.Group,
+				Label:    err.Label,
+				Message:  err.Message,
+				Severity: severity(err),
+			})
+		}
+
+		if r.URL.Query().Get("format") == "json" {
+			w.Header().Set("Content-Type", "application/json")
+			err = json.NewEncoder(w).Encode(status)
+		} else {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			err = writeTables(w, &status)
+		}
+		if err != nil {
+			logrus.Errorln("failed to write status response:", err.Error())
+		}
+	})
+}
+
+// ---------------------------------------------------------------------------------------
+//  private functions
+// ---------------------------------------------------------------------------------------
+
+// writeTables writes the status as human-readable tables.
+func writeTables(w http.ResponseWriter, status *Status) error {
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(table, "BACKEND\tHEALTHY\tMESSAGE")
+	for _, b := range status.Backends {
+		_, _ = fmt.Fprintf(table, "%s\t%t\t%s\n", b.Name, b.Healthy, b.Message)
+	}
+	_, _ = fmt.Fprintln(table)
+
+	if len(status.LabelErrors) < 1 {
+		_, _ = fmt.Fprintln(table, "all group labels are valid")
+		return table.Flush()
+	}
+
+	_, _ = fmt.Fprintln(table, "SEVERITY\tSERVICE\tGROUP\tLABEL\tMESSAGE")
+	for _, e := range status.LabelErrors {
+		_, _ = fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\n",
+			e.Severity, e.Service, e.Group, e.Label, e.Message)
+	}
+
+	return table.Flush()
+}
+
+// severity returns the severity of a label error.
+func severity(err *store.LabelError) string {
+	if err.Warning {
+		return "warning"
+	}
+
+	return "error"
+}
@@ -0,0 +1,303 @@
+package store
+
+// swarm-dns-sd
+// Copyright (C) 2020 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ---------------------------------------------------------------------------------------
+//  types
+// ---------------------------------------------------------------------------------------
+
+// Backend is a named store of a composite store.
+type Backend struct {
+	Name  string
+	Store Store
+}
+
+type composite struct {
+	backends []*Backend
+
+	// last error of a request to each backend
+	mutex sync.RWMutex
+	errs  map[string]error
+}
+
+// ---------------------------------------------------------------------------------------
+//  public functions
+// ---------------------------------------------------------------------------------------
+
+// NewComposite constructs a new Store which merges the endpoints of several
+// backends. Groups are served as long as one backend answers, the endpoints
+// of failing backends are left out. Endpoints with the same name are only
+// included once, the first backend takes precedence.
+func NewComposite(backends ...*Backend) Store {
+	return &composite{
+		backends: backends,
+		errs:     make(map[string]error),
+	}
+}
+
+// ---------------------------------------------------------------------------------------
+//  public members
+// ---------------------------------------------------------------------------------------
+
+// GetGroups returns the names of the groups of all backends in alphabetical order.
+func (c *composite) GetGroups() ([]string, error) {
+	groups := make([]string, 0)
+	seen := make(map[string]bool)
+
+	err := c.each(func(backend *Backend) error {
+		backendGroups, err := backend.Store.GetGroups()
+		for _, group := range backendGroups {
+			if !seen[group] {
+				seen[group] = true
+				groups = append(groups, group)
+			}
+		}
+		return err
+	})
+	sort.Strings(groups)
+
+	return groups, err
+}
+
+// GetGroupEndpoints returns the Endpoints of the group in all backends.
+func (c *composite) GetGroupEndpoints(group string) ([]*Endpoint, error) {
+	endpoints := make([]*Endpoint, 0)
+	names := make(map[string]bool)
+
+	err := c.each(func(backend *Backend) error {
+		eps, err := backend.Store.GetGroupEndpoints(group)
+		for _, ep := range eps {
+			if !names[ep.Name] {
+				names[ep.Name] = true
+				endpoints = append(endpoints, ep)
+			}
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return endpoints, nil
+}
+
+// GetTaskEndpoints returns the Endpoints of the task in the first backend knowing it.
+func (c *composite) GetTaskEndpoints(taskId string) ([]*Endpoint, error) {
+	var endpoints []*Endpoint
+	err := c.first(func(backend *Backend) (err error) {
+		endpoints, err = backend.Store.GetTaskEndpoints(taskId)
+		return err
+	})
+
+	return endpoints, err
+}
+
+// GetTaskIpAddresses returns the addresses of the task in the first backend knowing it.
+func (c *composite) GetTaskIpAddresses(taskId string, network string) (*Addresses, error) {
+	var addrs *Addresses
+	err := c.first(func(backend *Backend) (err error) {
+		addrs, err = backend.Store.GetTaskIpAddresses(taskId, network)
+		return err
+	})
+
+	return addrs, err
+}
+
+// GetVirtualIpAddresses returns the virtual IP addresses of the service
+// in the first backend knowing it.
+func (c *composite) GetVirtualIpAddresses(cluster string, service string, epName string, network string) (*Addresses, error) {
+	var addrs *Addresses
+	err := c.first(func(backend *Backend) (err error) {
+		addrs, err = backend.Store.GetVirtualIpAddresses(cluster, service, epName, network)
+		return err
+	})
+
+	return addrs, err
+}
+
+// GetVirtualIpEndpoints returns the Endpoints on the virtual IP
+// of the service in the first backend knowing it.
+func (c *composite) GetVirtualIpEndpoints(cluster string, service string) ([]*Endpoint, error) {
+	var endpoints []*Endpoint
+	err := c.first(func(backend *Backend) (err error) {
+		endpoints, err = backend.Store.GetVirtualIpEndpoints(cluster, service)
+		return err
+	})
+
+	return endpoints, err
+}
+
+// GetAddressEndpoints returns the Endpoints of the address in all backends.
+func (c *composite) GetAddressEndpoints(ip net.IP) ([]*Endpoint, error) {
+	endpoints := make([]*Endpoint, 0)
+	names := make(map[string]bool)
+
+	err := c.each(func(backend *Backend) error {
+		eps, err := backend.Store.GetAddressEndpoints(ip)
+		for _, ep := range eps {
+			if !names[ep.Name] {
+				names[ep.Name] = true
+				endpoints = append(endpoints, ep)
+			}
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return endpoints, nil
+}
+
+// GetLabelErrors returns the label errors of all backends.
+func (c *composite) GetLabelErrors() ([]*LabelError, error) {
+	labelErrors := make([]*LabelError, 0)
+	err := c.each(func(backend *Backend) error {
+		errs, err := backend.Store.GetLabelErrors()
+		labelErrors = append(labelErrors, errs...)
+		return err
+	})
+
+	return labelErrors, err
+}
+
+// GetRevision returns the sum of the revisions of all backends,
+// which increases whenever one of the backends changes.
+func (c *composite) GetRevision() uint64 {
+	var revision uint64
+	for _, backend := range c.backends {
+		revision += backend.Store.GetRevision()
+	}
+
+	return revision
+}
+
+// GetHealth returns the health of all backends. A backend is also
+// unhealthy if its last request failed.
+func (c *composite) GetHealth() []*BackendHealth {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	health := make([]*BackendHealth, 0, len(c.backends))
+	for _, backend := range c.backends {
+		for _, h := range backend.Store.GetHealth() {
+			name := backend.Name
+			if h.Backend != "" && h.Backend != backend.Name {
+				name += "/" + h.Backend
+			}
+
+			if err := c.errs[backend.Name]; h.Healthy && err != nil {
+				health = append(health, makeBackendHealth(name, err))
+			} else {
+				health = append(health, &BackendHealth{Backend: name, Healthy: h.Healthy, Message: h.Message})
+			}
+		}
+	}
+
+	return health
+}
+
+// ---------------------------------------------------------------------------------------
+//  private members
+// ---------------------------------------------------------------------------------------
+
+// each calls fn for all backends. Failing backends are skipped, an error is
+// only returned if no backend succeeded.
+func (c *composite) each(fn func(backend *Backend) error) error {
+	errs := make([]error, 0, len(c.backends))
+	for _, backend := range c.backends {
+		errs = append(errs, c.call(backend, fn))
+	}
+
+	return combineErrs(errs)
+}
+
+// first calls fn for the backends until one of them succeeds.
+func (c *composite) first(fn func(backend *Backend) error) error {
+	errs := make([]error, 0, len(c.backends))
+	for _, backend := range c.backends {
+		err := c.call(backend, fn)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, err)
+	}
+
+	return combineErrs(errs)
+}
+
+// call calls fn for a backend and records the result. Backends which
+// do not know the requested object are not failing.
+func (c *composite) call(backend *Backend, fn func(backend *Backend) error) error {
+	err := fn(backend)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		logrus.Errorf("backend \"%s\" failed: %s", backend.Name, err.Error())
+	}
+
+	c.mutex.Lock()
+	if errors.Is(err, ErrNotFound) {
+		c.errs[backend.Name] = nil
+	} else {
+		c.errs[backend.Name] = err
+	}
+	c.mutex.Unlock()
+
+	return err
+}
+
+// ---------------------------------------------------------------------------------------
+//  private functions
+// ---------------------------------------------------------------------------------------
+
+// combineErrs returns the error of a request which failed in all backends.
+// A failing backend might know the requested object, so ErrNotFound is
+// only returned if all backends reported it.
+func combineErrs(errs []error) error {
+	var failed, notFound error
+	for _, err := range errs {
+		switch {
+		case err == nil:
+			return nil
+		case errors.Is(err, ErrNotFound):
+			notFound = err
+		default:
+			failed = err
+		}
+	}
+
+	if failed != nil {
+		return fmt.Errorf("backend failed: %w", failed)
+	} else if notFound != nil {
+		return notFound
+	}
+
+	return fmt.Errorf("%w: no backends", ErrNotFound)
+}
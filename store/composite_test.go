@@ -0,0 +1,65 @@
+package store
+
+// swarm-dns-sd
+// Copyright (C) 2020 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// ---------------------------------------------------------------------------------------
+//  tests
+// ---------------------------------------------------------------------------------------
+
+func TestCombineErrs(t *testing.T) {
+	errFailed := errors.New("connection refused")
+	errMissing := fmt.Errorf("%w: group \"mon\"", ErrNotFound)
+
+	tests := []struct {
+		name     string
+		errs     []error
+		ok       bool
+		notFound bool
+		failed   bool
+	}{
+		{name: "no backends", errs: nil, notFound: true},
+		{name: "all succeeded", errs: []error{nil, nil}, ok: true},
+		{name: "one succeeded", errs: []error{errFailed, nil, errMissing}, ok: true},
+		{name: "all not found", errs: []error{errMissing, errMissing}, notFound: true},
+		{name: "one failed", errs: []error{errMissing, errFailed}, failed: true},
+		{name: "all failed", errs: []error{errFailed, errFailed}, failed: true},
+	}
+
+	for _, test := range tests {
+		err := combineErrs(test.errs)
+		switch {
+		case test.ok && err != nil:
+			t.Errorf("%s: expected no error, got %s", test.name, err)
+		case !test.ok && err == nil:
+			t.Errorf("%s: expected an error", test.name)
+		case test.notFound != errors.Is(err, ErrNotFound):
+			t.Errorf("%s: expected not found %t, got %s", test.name, test.notFound, err)
+		case test.failed != errors.Is(err, errFailed):
+			t.Errorf("%s: expected failure %t, got %s", test.name, test.failed, err)
+		}
+	}
+}
@@ -0,0 +1,579 @@
+package store
+
+// swarm-dns-sd
+// Copyright (C) 2020 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+	"github.com/sirupsen/logrus"
+)
+
+// ---------------------------------------------------------------------------------------
+//  constants
+// ---------------------------------------------------------------------------------------
+
+const (
+	// labels docker compose attaches to its containers
+	labelComposeProject = "com.docker.compose.project"
+	labelComposeService = "com.docker.compose.service"
+	labelComposeNumber  = "com.docker.compose.container-number"
+
+	// length of the container ID used in endpoint names
+	shortIdLength = 12
+)
+
+// ---------------------------------------------------------------------------------------
+//  types
+// ---------------------------------------------------------------------------------------
+
+type standalone struct {
+	snapshot
+
+	// in-memory snapshot of the running containers
+	containers map[string]types.ContainerJSON
+	hostname   string
+
+	// container IDs ordered by service and slot as of the current revision
+	containerIds []string
+}
+
+// ---------------------------------------------------------------------------------------
+//  public functions
+// ---------------------------------------------------------------------------------------
+
+// NewContainer constructs a new Store backed by the containers of a standalone
+// docker host. The group labels are taken from the containers instead of swarm
+// services, each container is treated like a task of its compose service.
+// The containers are kept up to date like in the swarm store.
+func NewContainer(resync time.Duration, ops ...client.Opt) (Store, error) {
+	s := standalone{
+		containers: make(map[string]types.ContainerJSON),
+	}
+	s.src = &s
+	s.resync = resync
+
+	var err error
+	s.client, err = client.NewClientWithOpts(ops...)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := s.client.Info(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	s.hostname = networkLabel(info.Name)
+
+	err = s.sync()
+	if err != nil {
+		return nil, err
+	}
+
+	go s.watch()
+
+	return &s, nil
+}
+
+// ---------------------------------------------------------------------------------------
+//  public members
+// ---------------------------------------------------------------------------------------
+
+// GetGroupEndpoints returns all Endpoints which belong to the given group.
+func (s *standalone) GetGroupEndpoints(group string) ([]*Endpoint, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	endpoints := make([]*Endpoint, 0)
+	groupExists := false
+
+	for _, container := range s.indexedContainers() {
+		// invalid groups of a container are left out
+		groupSpecs, errs := s.parsedLabels(container.ID)
+		for _, err := range errs {
+			if err.Group == group {
+				groupExists = true
+			}
+		}
+
+		endpointSpecs, ok := groupSpecs[group]
+		if !ok {
+			continue
+		}
+		groupExists = true
+
+		for _, epName := range sortedEndpointNames(endpointSpecs) {
+			epSpec := endpointSpecs[epName]
+			if !epSpec.AdmitsHealth(containerHealth(container)) {
+				continue
+			}
+
+			endpoints = append(endpoints, s.makeEndpoint(epName, epSpec, container))
+		}
+	}
+
+	if !groupExists {
+		return nil, fmt.Errorf("%w: group \"%s\"", ErrNotFound, group)
+	}
+
+	return endpoints, nil
+}
+
+// GetTaskEndpoints returns the Endpoints of a container in all groups.
+// Containers are referenced by their short ID.
+func (s *standalone) GetTaskEndpoints(taskId string) ([]*Endpoint, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	container, ok := s.findContainer(taskId)
+	if !ok {
+		return nil, fmt.Errorf("%w: container \"%s\"", ErrNotFound, taskId)
+	}
+
+	endpoints := make([]*Endpoint, 0)
+	names := make(map[string]bool)
+	groupSpecs, _ := s.parsedLabels(container.ID)
+	for _, group := range groupSpecs.sortedGroups() {
+		for _, epName := range sortedEndpointNames(groupSpecs[group]) {
+			epSpec := groupSpecs[group][epName]
+			endpoint := s.makeEndpoint(epName, epSpec, &container)
+			if !names[endpoint.Name] {
+				names[endpoint.Name] = true
+				endpoints = append(endpoints, endpoint)
+			}
+		}
+	}
+
+	return endpoints, nil
+}
+
+// GetTaskIpAddresses returns all IP addresses of a container on the given network.
+// The network is referenced by its ID, name or the name component of endpoint names.
+func (s *standalone) GetTaskIpAddresses(taskId string, network string) (*Addresses, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	container, ok := s.findContainer(taskId)
+	if !ok {
+		return nil, fmt.Errorf("%w: container \"%s\"", ErrNotFound, taskId)
+	}
+
+	_, settings := findContainerNetwork(&container, network)
+	if settings == nil {
+		return nil, fmt.Errorf("%w: container \"%s\" is not connected to network \"%s\"",
+			ErrNotFound, taskId, network)
+	}
+
+	addrs := &Addresses{Ttl: s.containerTtl(&container)}
+	if ip := net.ParseIP(settings.IPAddress); ip != nil {
+		addrs.IPv4 = append(addrs.IPv4, ip)
+	}
+	if ip := net.ParseIP(settings.GlobalIPv6Address); ip != nil {
+		addrs.IPv6 = append(addrs.IPv6, ip)
+	}
+
+	return addrs, nil
+}
+
+// GetVirtualIpAddresses always fails, as containers have no virtual IPs.
+func (s *standalone) GetVirtualIpAddresses(cluster string, service string, epName string, network string) (*Addresses, error) {
+	return nil, fmt.Errorf("%w: service \"%s\" has no virtual IP", ErrNotFound, service)
+}
+
+// GetVirtualIpEndpoints always fails, as containers have no virtual IPs.
+func (s *standalone) GetVirtualIpEndpoints(cluster string, service string) ([]*Endpoint, error) {
+	return nil, fmt.Errorf("%w: service \"%s\" has no virtual IP", ErrNotFound, service)
+}
+
+// GetAddressEndpoints returns all Endpoints of the container the address is assigned to.
+func (s *standalone) GetAddressEndpoints(ip net.IP) ([]*Endpoint, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	endpoints := make([]*Endpoint, 0)
+	names := make(map[string]bool)
+
+	for _, container := range s.indexedContainers() {
+		groupSpecs, _ := s.parsedLabels(container.ID)
+		for _, group := range groupSpecs.sortedGroups() {
+			for _, epName := range sortedEndpointNames(groupSpecs[group]) {
+				epSpec := groupSpecs[group][epName]
+				_, settings := findContainerNetwork(container, epSpec.Network)
+				if settings == nil || !(ip.Equal(net.ParseIP(settings.IPAddress)) ||
+					ip.Equal(net.ParseIP(settings.GlobalIPv6Address))) {
+					continue
+				}
+
+				endpoint := s.makeEndpoint(epName, epSpec, container)
+				if names[endpoint.Name] {
+					continue
+				}
+				names[endpoint.Name] = true
+
+				endpoints = append(endpoints, endpoint)
+			}
+		}
+	}
+
+	if len(endpoints) < 1 {
+		return nil, fmt.Errorf("%w: address \"%s\"", ErrNotFound, ip)
+	}
+
+	return endpoints, nil
+}
+
+// GetHealth reports the container store unhealthy while docker is unreachable.
+func (s *standalone) GetHealth() []*BackendHealth {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return []*BackendHealth{makeBackendHealth("container", s.syncErr)}
+}
+
+// ---------------------------------------------------------------------------------------
+//  private members
+// ---------------------------------------------------------------------------------------
+
+// sync replaces the in-memory snapshot with the running containers.
+func (s *standalone) sync() error {
+	ctx := context.Background()
+
+	list, err := s.client.ContainerList(ctx, types.ContainerListOptions{})
+	if err != nil {
+		return err
+	}
+
+	containers := make(map[string]types.ContainerJSON, len(list))
+	for _, entry := range list {
+		container, err := s.client.ContainerInspect(ctx, entry.ID)
+		if client.IsErrNotFound(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		containers[container.ID] = container
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.containers = containers
+	s.updateRevision()
+
+	logrus.Debugf("synced %d containers", len(containers))
+
+	return nil
+}
+
+// watch keeps the in-memory snapshot up to date by
+// processing the docker event stream and periodic resyncs.
+func (s *standalone) watch() {
+	filter := filters.NewArgs()
+	filter.Add("type", events.ContainerEventType)
+	filter.Add("type", events.NetworkEventType)
+
+	s.snapshot.watch(filter)
+}
+
+// handleEvent applies a single docker event to the in-memory snapshot.
+func (s *standalone) handleEvent(msg *events.Message) error {
+	logrus.Debugf("docker event: %s %s %s", msg.Type, msg.Action, msg.Actor.ID)
+
+	switch msg.Type {
+	case events.ContainerEventType:
+		switch {
+		case msg.Action == "die" || msg.Action == "destroy":
+			s.mutex.Lock()
+			delete(s.containers, msg.Actor.ID)
+			s.mutex.Unlock()
+
+		case msg.Action == "start" || msg.Action == "rename" ||
+			strings.HasPrefix(msg.Action, eventHealthStatus):
+			return s.inspectContainer(msg.Actor.ID)
+		}
+
+	case events.NetworkEventType:
+		// the addresses of a container change with its networks
+		if msg.Action == "connect" || msg.Action == "disconnect" {
+			return s.inspectContainer(msg.Actor.Attributes["container"])
+		}
+	}
+
+	return nil
+}
+
+// inspectContainer updates a single container of the in-memory snapshot.
+func (s *standalone) inspectContainer(id string) error {
+	container, err := s.client.ContainerInspect(context.Background(), id)
+	if client.IsErrNotFound(err) {
+		container.ContainerJSONBase = nil
+	} else if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if container.ContainerJSONBase == nil || container.State == nil || !container.State.Running {
+		delete(s.containers, id)
+		return nil
+	}
+	s.containers[container.ID] = container
+
+	return nil
+}
+
+// stateFingerprint returns a hash of the content of the snapshot.
+// The caller must hold the read lock.
+func (s *standalone) stateFingerprint() uint64 {
+	var fingerprint uint64
+	for id, container := range s.containers {
+		h := fnv.New64a()
+		_, _ = fmt.Fprintf(h, "%s/%s/%s/%s", id, container.Name,
+			container.State.StartedAt, containerHealth(&container))
+		if container.NetworkSettings != nil {
+			for name, settings := range container.NetworkSettings.Networks {
+				_, _ = fmt.Fprintf(h, "/%s=%s,%s", name, settings.IPAddress,
+					settings.GlobalIPv6Address)
+			}
+		}
+		fingerprint += h.Sum64()
+	}
+
+	return fingerprint
+}
+
+// parseLabels returns the group labels of all containers ordered
+// by service and slot. The caller must hold the read lock.
+func (s *standalone) parseLabels() []*serviceLabels {
+	labels := make([]*serviceLabels, 0, len(s.containers))
+	for _, container := range s.indexedContainers() {
+		groupSpecs, errs := s.groupSpecs(container)
+		labels = append(labels, &serviceLabels{id: container.ID, groupSpecs: groupSpecs, errs: errs})
+	}
+
+	return labels
+}
+
+// groupSpecs returns the endpoint specifications of a container by group
+// along with the errors of its group labels. Groups with an error are
+// omitted. The caller must hold the read lock.
+func (s *standalone) groupSpecs(container *types.ContainerJSON) (GroupSpecs, []*LabelError) {
+	return ParseServiceLabels(containerService(container), container.Config.Labels, func(epSpec *EndpointSpec) error {
+		if _, settings := findContainerNetwork(container, epSpec.Network); settings == nil {
+			return fmt.Errorf("container is not connected to network \"%s\"", epSpec.Network)
+		}
+
+		if epSpec.Vip {
+			return fmt.Errorf("containers have no virtual IP")
+		}
+		return nil
+	})
+}
+
+// makeEndpoint constructs the Endpoint of a container.
+// The caller must hold the read lock.
+func (s *standalone) makeEndpoint(epName string, epSpec *EndpointSpec, container *types.ContainerJSON) *Endpoint {
+	priority := uint16(DefaultPriority)
+	if epSpec.Priority != nil {
+		priority = *epSpec.Priority
+	}
+	priority = parseUint16Label(container.Config.Labels, LabelPriority, priority)
+
+	weight := uint16(DefaultWeight)
+	if epSpec.Weight != nil {
+		weight = *epSpec.Weight
+	}
+	weight = parseUint16Label(container.Config.Labels, LabelWeight, weight)
+
+	// the label might reference the network by ID or without project
+	network := epSpec.Network
+	if name, settings := findContainerNetwork(container, epSpec.Network); settings != nil {
+		network = name
+	}
+	network = networkLabel(network)
+
+	service := containerService(container)
+	slot := containerSlot(container)
+	taskId := shortId(container.ID)
+
+	return &Endpoint{
+		Name: fmt.Sprintf("%s.task-%d-%s.%s.%s.%s",
+			epName, slot, taskId, service, s.hostname, network),
+		Port:     epSpec.Port,
+		Ttl:      epSpec.Ttl,
+		Meta:     epSpec.Meta,
+		Priority: priority,
+		Weight:   weight,
+		SpecName: epName,
+		Service:  service,
+		Slot:     slot,
+		TaskId:   taskId,
+		Node:     s.hostname,
+		Network:  network,
+	}
+}
+
+// findContainer returns the container with the given short ID.
+// The caller must hold the read lock.
+func (s *standalone) findContainer(taskId string) (types.ContainerJSON, bool) {
+	for id, container := range s.containers {
+		if shortId(id) == taskId {
+			return container, true
+		}
+	}
+
+	return types.ContainerJSON{}, false
+}
+
+// containerTtl returns the shortest TTL of all endpoints of a container.
+// The caller must hold the read lock.
+func (s *standalone) containerTtl(container *types.ContainerJSON) uint32 {
+	var ttl uint32
+	groupSpecs, _ := s.parsedLabels(container.ID)
+	for _, endpointSpecs := range groupSpecs {
+		for _, epSpec := range endpointSpecs {
+			if epSpec.Ttl > 0 && (ttl == 0 || epSpec.Ttl < ttl) {
+				ttl = epSpec.Ttl
+			}
+		}
+	}
+
+	return ttl
+}
+
+// index orders the containers by service and slot, so the queries
+// of the revision do not have to. The caller must hold the write lock.
+func (s *standalone) index() {
+	s.containerIds = make([]string, 0, len(s.containers))
+	for id := range s.containers {
+		s.containerIds = append(s.containerIds, id)
+	}
+
+	sort.Slice(s.containerIds, func(i, j int) bool {
+		ci, cj := s.containers[s.containerIds[i]], s.containers[s.containerIds[j]]
+		si, sj := containerService(&ci), containerService(&cj)
+		if si != sj {
+			return si < sj
+		}
+		if containerSlot(&ci) != containerSlot(&cj) {
+			return containerSlot(&ci) < containerSlot(&cj)
+		}
+		return ci.ID < cj.ID
+	})
+}
+
+// indexedContainers returns the containers in the order of the index.
+// Containers removed since the last revision are skipped, containers
+// added are missing until the next revision. The caller must hold the
+// read lock.
+func (s *standalone) indexedContainers() []*types.ContainerJSON {
+	containers := make([]*types.ContainerJSON, 0, len(s.containerIds))
+	for _, id := range s.containerIds {
+		if container, ok := s.containers[id]; ok {
+			containers = append(containers, &container)
+		}
+	}
+
+	return containers
+}
+
+// ---------------------------------------------------------------------------------------
+//  private functions
+// ---------------------------------------------------------------------------------------
+
+// containerService returns the service name of a container, which is
+// "<project>_<service>" for containers of docker compose and the
+// container name otherwise.
+func containerService(container *types.ContainerJSON) string {
+	labels := container.Config.Labels
+	if service, ok := labels[labelComposeService]; ok {
+		return networkLabel(labels[labelComposeProject] + "_" + service)
+	}
+
+	return networkLabel(strings.TrimPrefix(container.Name, "/"))
+}
+
+// containerSlot returns the number of a container within its compose service.
+func containerSlot(container *types.ContainerJSON) int {
+	slot, err := strconv.Atoi(container.Config.Labels[labelComposeNumber])
+	if err != nil {
+		return 1
+	}
+
+	return slot
+}
+
+// containerHealth returns the health status of a container,
+// which is empty for containers without healthcheck.
+func containerHealth(container *types.ContainerJSON) string {
+	if container.State == nil || container.State.Health == nil {
+		return ""
+	}
+
+	return container.State.Health.Status
+}
+
+// findContainerNetwork returns the name and settings of the network referenced by
+// ID, name or the name component of endpoint names. Networks of the compose
+// project can be referenced without the project name.
+func findContainerNetwork(container *types.ContainerJSON, ref string) (string, *network.EndpointSettings) {
+	if container.NetworkSettings == nil {
+		return "", nil
+	}
+
+	refs := []string{ref}
+	if project, ok := container.Config.Labels[labelComposeProject]; ok {
+		refs = append(refs, project+"_"+ref)
+	}
+
+	for _, ref := range refs {
+		for name, settings := range container.NetworkSettings.Networks {
+			if settings != nil && (settings.NetworkID == ref || strings.EqualFold(name, ref) ||
+				strings.EqualFold(networkLabel(name), ref)) {
+				return name, settings
+			}
+		}
+	}
+
+	return "", nil
+}
+
+// shortId returns the abbreviated form of a container ID.
+func shortId(id string) string {
+	if len(id) > shortIdLength {
+		return id[:shortIdLength]
+	}
+
+	return id
+}
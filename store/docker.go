@@ -22,12 +22,17 @@ package store
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
+	"hash/fnv"
 	"net"
-	"sync"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
 	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/api/types/swarm"
 	"github.com/docker/docker/client"
@@ -39,7 +44,36 @@ import (
 // ---------------------------------------------------------------------------------------
 
 const (
-	LabelGroup = "kallax.group"
+	// SRV priority and weight overrides on nodes and containers
+	LabelPriority = "kallax.priority"
+	LabelWeight   = "kallax.weight"
+
+	// labels docker attaches to the containers of swarm tasks
+	labelSwarmServiceId = "com.docker.swarm.service.id"
+	labelSwarmTaskId    = "com.docker.swarm.task.id"
+
+	// label docker stack attaches to the services of a stack
+	labelStackNamespace = "com.docker.stack.namespace"
+
+	// prefix of the container event reporting a health status change
+	eventHealthStatus = "health_status: "
+
+	// interval of polling the tasks of all services, which catches
+	// task changes on nodes other than the connected docker host
+	taskPollInterval = 5 * time.Second
+
+	// interval and time limit of resyncing the tasks of a service
+	// after a service event until the service has converged
+	convergeInterval = time.Second
+	convergeTimeout  = 5 * time.Minute
+)
+
+// ---------------------------------------------------------------------------------------
+//  global variables
+// ---------------------------------------------------------------------------------------
+
+var (
+	reInvalidLabelChars = regexp.MustCompile("[^A-Za-z0-9_-]")
 )
 
 // ---------------------------------------------------------------------------------------
@@ -47,10 +81,25 @@ const (
 // ---------------------------------------------------------------------------------------
 
 type docker struct {
-	client *client.Client
+	snapshot
+	cluster string
+
+	// in-memory snapshot of the swarm cluster
+	services map[string]swarm.Service
+	tasks    map[string]swarm.Task
+	networks map[string]types.NetworkResource
+	nodes    map[string]swarm.Node
+
+	// container health status of the tasks running on the docker host
+	health map[string]string
 
-	nodesNames     map[string]string
-	nodeNamesMutex sync.Mutex
+	// services whose tasks are resynced until they have converged
+	converging map[string]bool
+
+	// service IDs ordered by name and task IDs of each
+	// service ordered by slot as of the current revision
+	serviceIds []string
+	taskIds    map[string][]string
 }
 
 // ---------------------------------------------------------------------------------------
@@ -58,18 +107,46 @@ type docker struct {
 // ---------------------------------------------------------------------------------------
 
 // NewDocker constructs a new Store backed by a docker Swarm cluster.
-func NewDocker(ops ...client.Opt) (Store, error) {
-	d := docker{
-		nodesNames: make(map[string]string),
+// The whole cluster state is loaded into memory and kept up to date
+// by the docker event stream and by polling the tasks, as task changes
+// on other nodes emit no events. Additionally a full resync is performed
+// every resync interval in order to catch missed events.
+func NewDocker(resync time.Duration, ops ...client.Opt) (Store, error) {
+	d, err := newDocker("", resync, ops...)
+	if err != nil {
+		return nil, err
 	}
 
-	var err error
-	d.client, err = client.NewClientWithOpts(ops...)
+	err = d.sync()
 	if err != nil {
 		return nil, err
 	}
 
-	return &d, nil
+	go d.watch()
+	go d.pollTasks()
+
+	return d, nil
+}
+
+// NewDockerCluster constructs a Store like NewDocker, whose endpoints are
+// marked with the name of the cluster. An unreachable cluster is not an error,
+// the store stays empty and unhealthy until the cluster can be synced.
+func NewDockerCluster(cluster string, resync time.Duration, ops ...client.Opt) (Store, error) {
+	d, err := newDocker(cluster, resync, ops...)
+	if err != nil {
+		return nil, err
+	}
+
+	err = d.sync()
+	if err != nil {
+		logrus.Errorf("failed to sync cluster \"%s\": %s", cluster, err.Error())
+	}
+	d.setSyncErr(err)
+
+	go d.watch()
+	go d.pollTasks()
+
+	return d, nil
 }
 
 // ---------------------------------------------------------------------------------------
@@ -78,59 +155,87 @@ func NewDocker(ops ...client.Opt) (Store, error) {
 
 // GetGroupEndpoints returns all Endpoints which belong to the given group.
 func (d *docker) GetGroupEndpoints(group string) ([]*Endpoint, error) {
-	groupLabel := LabelGroup + "." + group
-
-	// find all swarm services with the group label
-	filter := filters.NewArgs()
-	filter.Add("label", groupLabel)
-	services, err := d.client.ServiceList(context.Background(), types.ServiceListOptions{
-		Filters: filter,
-	})
-	if err != nil {
-		return nil, err
-	}
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
 
 	endpoints := make([]*Endpoint, 0)
+	groupExists := false
 
-	for _, service := range services {
-		// parse endpoint specification from swarm label
-		var endpointSpecs map[string]*EndpointSpec
-		err = json.Unmarshal([]byte(service.Spec.Labels[groupLabel]), &endpointSpecs)
-		if err != nil {
-			return nil, err
+	for _, service := range d.indexedServices() {
+		// services with invalid labels are skipped, the
+		// errors are reported by GetLabelErrors
+		groupSpecs, errs := d.parsedLabels(service.ID)
+		for _, err := range errs {
+			if err.Group == group {
+				groupExists = true
+			}
 		}
 
-		// find all swarm tasks beloging to the service
-		filter := filters.NewArgs()
-		filter.Add("service", service.ID)
-		tasks, err := d.client.TaskList(context.Background(), types.TaskListOptions{
-			Filters: filter,
-		})
-		if err != nil {
-			return nil, err
+		endpointSpecs, ok := groupSpecs[group]
+		if !ok {
+			continue
 		}
+		groupExists = true
 
-		for _, task := range tasks {
+		// endpoints on the virtual IP exist once per service
+		epNames := sortedEndpointNames(endpointSpecs)
+		for _, epName := range epNames {
+			epSpec := endpointSpecs[epName]
+			if epSpec.Vip && d.hasAdmittedTask(service.ID, epSpec) {
+				endpoints = append(endpoints, d.makeVipEndpoint(epName, epSpec, service))
+			}
+		}
+
+		for _, task := range d.indexedTasks(service.ID) {
 			// we are only interested in running tasks
 			// other tasks cannot be connected to
 			if task.Status.State != swarm.TaskStateRunning {
 				continue
 			}
 
-			// convert the node ID to a user readable name
-			nodeName, err := d.getNodeName(task.NodeID)
-			if err != nil {
-				logrus.Errorln("failed to query node name:", err.Error())
-				nodeName = task.NodeID
+			for _, epName := range epNames {
+				epSpec := endpointSpecs[epName]
+				if epSpec.Vip || !epSpec.AdmitsHealth(d.health[task.ID]) {
+					continue
+				}
+
+				endpoints = append(endpoints, d.makeEndpoint(epName, epSpec, service, task))
 			}
+		}
+	}
+
+	if !groupExists {
+		return nil, fmt.Errorf("%w: group \"%s\"", ErrNotFound, group)
+	}
+
+	return endpoints, nil
+}
+
+// GetTaskEndpoints returns the Endpoints of a task in all groups.
+func (d *docker) GetTaskEndpoints(taskId string) ([]*Endpoint, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	task, ok := d.tasks[taskId]
+	if !ok {
+		return nil, fmt.Errorf("%w: task \"%s\"", ErrNotFound, taskId)
+	}
+
+	service, ok := d.services[task.ServiceID]
+	if !ok {
+		return nil, fmt.Errorf("%w: service \"%s\"", ErrNotFound, task.ServiceID)
+	}
 
-			for epName, epSpec := range endpointSpecs {
-				endpoints = append(endpoints, &Endpoint{
-					Name: fmt.Sprintf("%s.task-%d-%s.%s.%s.%s",
-						epName, task.Slot, task.ID, service.Spec.Name,
-						nodeName, epSpec.Network),
-					Port: epSpec.Port,
-				})
+	endpoints := make([]*Endpoint, 0)
+	names := make(map[string]bool)
+	groupSpecs, _ := d.parsedLabels(service.ID)
+	for _, group := range groupSpecs.sortedGroups() {
+		for _, epName := range sortedEndpointNames(groupSpecs[group]) {
+			epSpec := groupSpecs[group][epName]
+			endpoint := d.makeEndpoint(epName, epSpec, &service, &task)
+			if !names[endpoint.Name] {
+				names[endpoint.Name] = true
+				endpoints = append(endpoints, endpoint)
 			}
 		}
 	}
@@ -138,51 +243,897 @@ func (d *docker) GetGroupEndpoints(group string) ([]*Endpoint, error) {
 	return endpoints, nil
 }
 
-func (d *docker) GetTaskIpAddresses(taskId string, networkId string) (string, error) {
-	task, _, err := d.client.TaskInspectWithRaw(context.Background(), taskId)
-	if err != nil {
-		return "", err
+// GetTaskIpAddresses returns all IP addresses of a task on the given network.
+// The network is referenced by its ID, name or the name component of endpoint names.
+func (d *docker) GetTaskIpAddresses(taskId string, network string) (*Addresses, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	task, ok := d.tasks[taskId]
+	if !ok {
+		return nil, fmt.Errorf("%w: task \"%s\"", ErrNotFound, taskId)
 	}
 
-	ip := ""
-	for _, network := range task.NetworksAttachments {
-		if network.Network.ID == networkId && len(network.Addresses) > 0 {
-			addr, _, err := net.ParseCIDR(network.Addresses[0])
+	service := d.services[task.ServiceID]
+	attachment := findAttachment(&service, &task, network)
+	if attachment == nil {
+		return nil, fmt.Errorf("%w: task \"%s\" is not attached to network \"%s\"",
+			ErrNotFound, taskId, network)
+	}
+
+	addrs := &Addresses{Ttl: d.serviceTtl(task.ServiceID)}
+	for _, cidr := range attachment.Addresses {
+		addr, _, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+
+		if addr.To4() != nil {
+			addrs.IPv4 = append(addrs.IPv4, addr)
+		} else {
+			addrs.IPv6 = append(addrs.IPv6, addr)
+		}
+	}
+
+	return addrs, nil
+}
+
+// GetVirtualIpAddresses returns the virtual IP addresses of a service on the
+// given network, if the store belongs to the cluster. The service must have
+// an endpoint of the given name on the virtual IP. The network is referenced
+// like in GetTaskIpAddresses.
+func (d *docker) GetVirtualIpAddresses(cluster string, serviceName string, epName string, network string) (*Addresses, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	if cluster != d.cluster {
+		return nil, fmt.Errorf("%w: cluster \"%s\"", ErrNotFound, cluster)
+	}
+
+	for _, service := range d.indexedServices() {
+		if !strings.EqualFold(service.Spec.Name, serviceName) {
+			continue
+		}
+
+		groupSpecs, _ := d.parsedLabels(service.ID)
+		for _, endpointSpecs := range groupSpecs {
+			epSpec, ok := endpointSpecs[epName]
+			if !ok || !epSpec.Vip {
+				continue
+			}
+
+			vip := d.findVirtualIp(service, network)
+			if vip == nil {
+				break
+			}
+
+			addr, _, err := net.ParseCIDR(vip.Addr)
 			if err != nil {
-				return "", err
+				return nil, err
+			}
+
+			addrs := &Addresses{Ttl: d.serviceTtl(service.ID)}
+			if addr.To4() != nil {
+				addrs.IPv4 = append(addrs.IPv4, addr)
+			} else {
+				addrs.IPv6 = append(addrs.IPv6, addr)
+			}
+
+			return addrs, nil
+		}
+
+		return nil, fmt.Errorf("%w: service \"%s\" has no virtual IP endpoint \"%s\" on network \"%s\"",
+			ErrNotFound, serviceName, epName, network)
+	}
+
+	return nil, fmt.Errorf("%w: service \"%s\"", ErrNotFound, serviceName)
+}
+
+// GetVirtualIpEndpoints returns the Endpoints on the virtual IP of a service
+// in all groups, if the store belongs to the cluster.
+func (d *docker) GetVirtualIpEndpoints(cluster string, serviceName string) ([]*Endpoint, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	if cluster != d.cluster {
+		return nil, fmt.Errorf("%w: cluster \"%s\"", ErrNotFound, cluster)
+	}
+
+	for _, service := range d.indexedServices() {
+		if !strings.EqualFold(service.Spec.Name, serviceName) {
+			continue
+		}
+
+		endpoints := make([]*Endpoint, 0)
+		names := make(map[string]bool)
+		groupSpecs, _ := d.parsedLabels(service.ID)
+		for _, group := range groupSpecs.sortedGroups() {
+			for _, epName := range sortedEndpointNames(groupSpecs[group]) {
+				epSpec := groupSpecs[group][epName]
+				if !epSpec.Vip {
+					continue
+				}
+
+				endpoint := d.makeVipEndpoint(epName, epSpec, service)
+				if !names[endpoint.Name] {
+					names[endpoint.Name] = true
+					endpoints = append(endpoints, endpoint)
+				}
 			}
+		}
 
-			ip = addr.String()
+		return endpoints, nil
+	}
+
+	return nil, fmt.Errorf("%w: service \"%s\"", ErrNotFound, serviceName)
+}
+
+// GetAddressEndpoints returns all Endpoints of the task the address is assigned to.
+func (d *docker) GetAddressEndpoints(ip net.IP) ([]*Endpoint, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	endpoints := make([]*Endpoint, 0)
+	names := make(map[string]bool)
+
+	for _, service := range d.indexedServices() {
+		groupSpecs, _ := d.parsedLabels(service.ID)
+		for _, group := range groupSpecs.sortedGroups() {
+			endpointSpecs := groupSpecs[group]
+			epNames := sortedEndpointNames(endpointSpecs)
+			for _, task := range d.indexedTasks(service.ID) {
+				if task.Status.State != swarm.TaskStateRunning {
+					continue
+				}
+
+				for _, epName := range epNames {
+					epSpec := endpointSpecs[epName]
+					if !hasAddress(findAttachment(service, task, epSpec.Network), ip) {
+						continue
+					}
+
+					endpoint := d.makeEndpoint(epName, epSpec, service, task)
+					if names[endpoint.Name] {
+						continue
+					}
+					names[endpoint.Name] = true
+
+					endpoints = append(endpoints, endpoint)
+				}
+			}
 		}
 	}
 
-	if ip == "" {
-		return "", fmt.Errorf("task \"%s\" is not attached to network \"%s\"",
-			taskId, networkId)
+	if len(endpoints) < 1 {
+		return nil, fmt.Errorf("%w: address \"%s\"", ErrNotFound, ip)
 	}
 
-	return ip, nil
+	return endpoints, nil
+}
+
+// GetHealth reports the swarm store unhealthy while docker is unreachable.
+func (d *docker) GetHealth() []*BackendHealth {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	return []*BackendHealth{makeBackendHealth("swarm", d.syncErr)}
 }
 
 // ---------------------------------------------------------------------------------------
 //  private members
 // ---------------------------------------------------------------------------------------
 
-// getNodeName returns the name of a swarm nodeby its ID.
-func (d *docker) getNodeName(nodeId string) (string, error) {
-	d.nodeNamesMutex.Lock()
-	defer d.nodeNamesMutex.Unlock()
+// sync replaces the in-memory snapshot with the current cluster state.
+func (d *docker) sync() error {
+	ctx := context.Background()
 
-	nodeName, ok := d.nodesNames[nodeId]
-	if !ok {
-		node, _, err := d.client.NodeInspectWithRaw(context.Background(), nodeId)
+	services, err := d.client.ServiceList(ctx, types.ServiceListOptions{})
+	if err != nil {
+		return err
+	}
+
+	// tasks which are not supposed to be running are of no interest
+	filter := filters.NewArgs()
+	filter.Add("desired-state", string(swarm.TaskStateRunning))
+	tasks, err := d.client.TaskList(ctx, types.TaskListOptions{Filters: filter})
+	if err != nil {
+		return err
+	}
+
+	networks, err := d.client.NetworkList(ctx, types.NetworkListOptions{})
+	if err != nil {
+		return err
+	}
+
+	nodes, err := d.client.NodeList(ctx, types.NodeListOptions{})
+	if err != nil {
+		return err
+	}
+
+	health, err := d.listHealth()
+	if err != nil {
+		return err
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.services = make(map[string]swarm.Service, len(services))
+	for _, service := range services {
+		d.services[service.ID] = service
+	}
+
+	d.tasks = make(map[string]swarm.Task, len(tasks))
+	for _, task := range tasks {
+		d.tasks[task.ID] = task
+	}
+
+	d.networks = make(map[string]types.NetworkResource, len(networks))
+	for _, network := range networks {
+		d.networks[network.ID] = network
+	}
+
+	d.nodes = make(map[string]swarm.Node, len(nodes))
+	for _, node := range nodes {
+		d.nodes[node.ID] = node
+	}
+
+	d.health = health
+
+	d.updateRevision()
+
+	logrus.Debugf("synced %d services, %d tasks, %d networks and %d nodes",
+		len(services), len(tasks), len(networks), len(nodes))
+
+	return nil
+}
+
+// watch keeps the in-memory snapshot up to date by
+// processing the docker event stream and periodic resyncs.
+func (d *docker) watch() {
+	filter := filters.NewArgs()
+	filter.Add("type", events.ServiceEventType)
+	filter.Add("type", events.NodeEventType)
+	filter.Add("type", events.NetworkEventType)
+	filter.Add("type", events.ContainerEventType)
+
+	d.snapshot.watch(filter)
+}
+
+// handleEvent applies a single docker event to the in-memory snapshot.
+func (d *docker) handleEvent(msg *events.Message) error {
+	ctx := context.Background()
+	logrus.Debugf("docker event: %s %s %s", msg.Type, msg.Action, msg.Actor.ID)
+
+	switch msg.Type {
+	case events.ServiceEventType:
+		if msg.Action == "remove" {
+			d.mutex.Lock()
+			delete(d.services, msg.Actor.ID)
+			d.mutex.Unlock()
+			return d.syncServiceTasks(msg.Actor.ID)
+		}
+
+		service, _, err := d.client.ServiceInspectWithRaw(ctx, msg.Actor.ID,
+			types.ServiceInspectOptions{})
+		if err != nil {
+			return err
+		}
+
+		d.mutex.Lock()
+		d.services[service.ID] = service
+		d.mutex.Unlock()
+
+		// the new tasks of an updated service are started
+		// after the event, so they are resynced until running
+		go d.convergeService(service.ID)
+		return d.syncServiceTasks(service.ID)
+
+	case events.NodeEventType:
+		if msg.Action == "remove" {
+			d.mutex.Lock()
+			delete(d.nodes, msg.Actor.ID)
+			d.mutex.Unlock()
+			return nil
+		}
+
+		node, _, err := d.client.NodeInspectWithRaw(ctx, msg.Actor.ID)
+		if err != nil {
+			return err
+		}
+
+		d.mutex.Lock()
+		d.nodes[node.ID] = node
+		d.mutex.Unlock()
+
+	case events.NetworkEventType:
+		if msg.Action == "destroy" || msg.Action == "remove" {
+			d.mutex.Lock()
+			delete(d.networks, msg.Actor.ID)
+			d.mutex.Unlock()
+			return nil
+		}
+
+		network, err := d.client.NetworkInspect(ctx, msg.Actor.ID,
+			types.NetworkInspectOptions{})
+		if err != nil {
+			return err
+		}
+
+		d.mutex.Lock()
+		d.networks[network.ID] = network
+		d.mutex.Unlock()
+
+	case events.ContainerEventType:
+		// docker does not emit events for swarm tasks, but the state
+		// changes of their containers on the connected docker host
+		// indicate task changes. Tasks on other nodes are polled.
+		serviceId, ok := msg.Actor.Attributes[labelSwarmServiceId]
+		if !ok {
+			return nil
+		}
+
+		// the health status is applied right away
+		if strings.HasPrefix(msg.Action, eventHealthStatus) {
+			d.mutex.Lock()
+			taskId := msg.Actor.Attributes[labelSwarmTaskId]
+			d.health[taskId] = strings.TrimPrefix(msg.Action, eventHealthStatus)
+			d.mutex.Unlock()
+			return nil
+		}
+
+		switch msg.Action {
+		case "die", "destroy":
+			d.mutex.Lock()
+			delete(d.health, msg.Actor.Attributes[labelSwarmTaskId])
+			d.mutex.Unlock()
+			return d.syncServiceTasks(serviceId)
+
+		case "start":
+			return d.syncServiceTasks(serviceId)
+		}
+	}
+
+	return nil
+}
+
+// pollTasks periodically replaces the tasks of all services with the
+// current state from the swarm manager. Container events are only
+// emitted by the connected docker host, this catches the rest.
+func (d *docker) pollTasks() {
+	ticker := time.NewTicker(taskPollInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		filter := filters.NewArgs()
+		filter.Add("desired-state", string(swarm.TaskStateRunning))
+		tasks, err := d.client.TaskList(context.Background(), types.TaskListOptions{Filters: filter})
 		if err != nil {
-			return "", err
+			logrus.Errorln("failed to poll swarm tasks:", err.Error())
+			continue
 		}
 
+		d.mutex.Lock()
+		d.tasks = make(map[string]swarm.Task, len(tasks))
+		for _, task := range tasks {
+			d.tasks[task.ID] = task
+		}
+		d.updateRevision()
+		d.mutex.Unlock()
+	}
+}
+
+// convergeService resyncs the tasks of a service until its update has
+// finished and all desired tasks are running, or the time limit is hit.
+// Only one resync loop is running per service.
+func (d *docker) convergeService(serviceId string) {
+	d.mutex.Lock()
+	if d.converging[serviceId] {
+		d.mutex.Unlock()
+		return
+	}
+	d.converging[serviceId] = true
+	d.mutex.Unlock()
+
+	defer func() {
+		d.mutex.Lock()
+		delete(d.converging, serviceId)
+		d.mutex.Unlock()
+	}()
+
+	deadline := time.Now().Add(convergeTimeout)
+	for time.Now().Before(deadline) {
+		time.Sleep(convergeInterval)
+
+		service, _, err := d.client.ServiceInspectWithRaw(context.Background(), serviceId,
+			types.ServiceInspectOptions{})
+		if client.IsErrNotFound(err) {
+			return
+		} else if err != nil {
+			logrus.Errorf("failed to inspect service \"%s\": %s", serviceId, err.Error())
+			continue
+		}
+
+		d.mutex.Lock()
+		d.services[service.ID] = service
+		d.mutex.Unlock()
+
+		err = d.syncServiceTasks(serviceId)
+		if err != nil {
+			logrus.Errorf("failed to sync tasks of service \"%s\": %s", serviceId, err.Error())
+			continue
+		}
+
+		d.mutex.Lock()
+		d.updateRevision()
+		converged := d.hasConverged(&service)
+		d.mutex.Unlock()
+
+		if converged {
+			logrus.Debugf("service \"%s\" has converged", service.Spec.Name)
+			return
+		}
+	}
+
+	logrus.Warnf("service \"%s\" has not converged within %s", serviceId, convergeTimeout)
+}
+
+// listHealth returns the container health status of all swarm tasks
+// running on the docker host. Tasks without an unhealthy or starting
+// container are omitted, as they are treated alike.
+func (d *docker) listHealth() (map[string]string, error) {
+	health := make(map[string]string)
+	for _, status := range []string{types.Unhealthy, types.Starting} {
+		filter := filters.NewArgs()
+		filter.Add("label", labelSwarmTaskId)
+		filter.Add("health", status)
+		containers, err := d.client.ContainerList(context.Background(),
+			types.ContainerListOptions{Filters: filter})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, container := range containers {
+			health[container.Labels[labelSwarmTaskId]] = status
+		}
+	}
+
+	return health, nil
+}
+
+// syncServiceTasks replaces all tasks of the given service
+// with the current state from the swarm manager.
+func (d *docker) syncServiceTasks(serviceId string) error {
+	filter := filters.NewArgs()
+	filter.Add("service", serviceId)
+	filter.Add("desired-state", string(swarm.TaskStateRunning))
+	tasks, err := d.client.TaskList(context.Background(), types.TaskListOptions{
+		Filters: filter,
+	})
+	if err != nil && !client.IsErrNotFound(err) {
+		return err
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	for id, task := range d.tasks {
+		if task.ServiceID == serviceId {
+			delete(d.tasks, id)
+		}
+	}
+
+	for _, task := range tasks {
+		d.tasks[task.ID] = task
+	}
+
+	return nil
+}
+
+// stateFingerprint returns a hash of the content of the snapshot.
+// The caller must hold the read lock.
+func (d *docker) stateFingerprint() uint64 {
+	var fingerprint uint64
+	add := func(id string, version uint64) {
+		h := fnv.New64a()
+		_, _ = fmt.Fprintf(h, "%s/%d", id, version)
+		fingerprint += h.Sum64()
+	}
+
+	for id, service := range d.services {
+		add(id, service.Version.Index)
+	}
+	for id, task := range d.tasks {
+		add(id, task.Version.Index)
+	}
+	for id := range d.networks {
+		add(id, 0)
+	}
+	for id, node := range d.nodes {
+		add(id, node.Version.Index)
+	}
+	for id, status := range d.health {
+		add(id+"/"+status, 0)
+	}
+
+	return fingerprint
+}
+
+// parseLabels returns the group labels of all services ordered
+// by their name. The caller must hold the read lock.
+func (d *docker) parseLabels() []*serviceLabels {
+	labels := make([]*serviceLabels, 0, len(d.services))
+	for _, service := range d.indexedServices() {
+		groupSpecs, errs := d.groupSpecs(service)
+		labels = append(labels, &serviceLabels{id: service.ID, groupSpecs: groupSpecs, errs: errs})
+	}
+
+	return labels
+}
+
+// groupSpecs returns the endpoint specifications of a service by group
+// along with the errors of its group labels. Groups with an error are
+// omitted, so a single invalid service does not affect the rest of the
+// group. The caller must hold the read lock.
+func (d *docker) groupSpecs(service *swarm.Service) (GroupSpecs, []*LabelError) {
+	return ParseServiceLabels(service.Spec.Name, service.Spec.Labels, func(epSpec *EndpointSpec) error {
+		if !d.hasNetwork(service, epSpec.Network) {
+			return fmt.Errorf("unknown network \"%s\"", epSpec.Network)
+		}
+
+		endpointSpec := service.Spec.EndpointSpec
+		if epSpec.Vip && endpointSpec != nil && endpointSpec.Mode == swarm.ResolutionModeDNSRR {
+			return fmt.Errorf("the service has no virtual IP in endpoint mode \"%s\"", endpointSpec.Mode)
+		}
+		return nil
+	})
+}
+
+// hasNetwork returns true if the network referenced by ID, name or the name
+// component of endpoint names exists. Networks of the service's stack can be
+// referenced without the stack namespace. The caller must hold the read lock.
+func (d *docker) hasNetwork(service *swarm.Service, network string) bool {
+	for _, ref := range networkRefs(service, network) {
+		for id, resource := range d.networks {
+			if id == ref || strings.EqualFold(resource.Name, ref) ||
+				strings.EqualFold(networkLabel(resource.Name), ref) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// findVirtualIp returns the virtual IP of a service on the network referenced
+// like in hasNetwork. The caller must hold the read lock.
+func (d *docker) findVirtualIp(service *swarm.Service, network string) *swarm.EndpointVirtualIP {
+	for _, ref := range networkRefs(service, network) {
+		for i, vip := range service.Endpoint.VirtualIPs {
+			resource, ok := d.networks[vip.NetworkID]
+			if vip.NetworkID == ref ||
+				(ok && (strings.EqualFold(resource.Name, ref) ||
+					strings.EqualFold(networkLabel(resource.Name), ref))) {
+				return &service.Endpoint.VirtualIPs[i]
+			}
+		}
+	}
+
+	return nil
+}
+
+// hasConverged returns true if the update of a service has finished and
+// all of its desired tasks are running. The caller must hold the read lock.
+func (d *docker) hasConverged(service *swarm.Service) bool {
+	if status := service.UpdateStatus; status != nil {
+		switch status.State {
+		case swarm.UpdateStateUpdating, swarm.UpdateStateRollbackStarted:
+			return false
+		}
+	}
+
+	running := 0
+	for _, task := range d.indexedTasks(service.ID) {
+		if task.Status.State != swarm.TaskStateRunning {
+			return false
+		}
+		running++
+	}
+
+	replicated := service.Spec.Mode.Replicated
+	if replicated != nil && replicated.Replicas != nil {
+		return uint64(running) >= *replicated.Replicas
+	}
+
+	return true
+}
+
+// hasAdmittedTask returns true if the service has a running task which
+// is admitted by the health policy. The caller must hold the read lock.
+func (d *docker) hasAdmittedTask(serviceId string, epSpec *EndpointSpec) bool {
+	for _, task := range d.indexedTasks(serviceId) {
+		if task.Status.State == swarm.TaskStateRunning && epSpec.AdmitsHealth(d.health[task.ID]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// makeVipEndpoint constructs the Endpoint of a service's virtual IP.
+// The caller must hold the read lock.
+func (d *docker) makeVipEndpoint(epName string, epSpec *EndpointSpec, service *swarm.Service) *Endpoint {
+	network := epSpec.Network
+	if vip := d.findVirtualIp(service, epSpec.Network); vip != nil {
+		if resource, ok := d.networks[vip.NetworkID]; ok {
+			network = resource.Name
+		}
+	}
+	network = networkLabel(network)
+
+	priority, weight := d.srvParameters(epSpec, nil)
+
+	// services of the same name can exist in several clusters
+	name := fmt.Sprintf("%s.%s.%s.vip", epName, service.Spec.Name, network)
+	if d.cluster != "" {
+		name = fmt.Sprintf("%s.%s.%s.%s.vip", epName, service.Spec.Name, network, d.cluster)
+	}
+
+	return &Endpoint{
+		Name:     name,
+		Port:     epSpec.Port,
+		Ttl:      epSpec.Ttl,
+		Meta:     epSpec.Meta,
+		Priority: priority,
+		Weight:   weight,
+		Vip:      true,
+		SpecName: epName,
+		Service:  service.Spec.Name,
+		Network:  network,
+		Cluster:  d.cluster,
+	}
+}
+
+// makeEndpoint constructs the Endpoint of a task.
+// The caller must hold the read lock.
+func (d *docker) makeEndpoint(epName string, epSpec *EndpointSpec, service *swarm.Service, task *swarm.Task) *Endpoint {
+	// convert the node ID to a user readable name
+	nodeName := task.NodeID
+	if node, ok := d.nodes[task.NodeID]; ok {
 		nodeName = node.Description.Hostname
-		d.nodesNames[nodeId] = node.Description.Hostname
 	}
 
-	return nodeName, nil
+	priority, weight := d.srvParameters(epSpec, task)
+
+	// the network name is preferred over its ID, as it is human-readable
+	// and stays the same when the network is recreated
+	network := epSpec.Network
+	if attachment := findAttachment(service, task, epSpec.Network); attachment != nil {
+		network = attachment.Network.Spec.Name
+	}
+	network = networkLabel(network)
+
+	return &Endpoint{
+		Name: fmt.Sprintf("%s.task-%d-%s.%s.%s.%s",
+			epName, task.Slot, task.ID, service.Spec.Name, nodeName, network),
+		Port:     epSpec.Port,
+		Ttl:      epSpec.Ttl,
+		Meta:     epSpec.Meta,
+		Priority: priority,
+		Weight:   weight,
+		SpecName: epName,
+		Service:  service.Spec.Name,
+		Slot:     task.Slot,
+		TaskId:   task.ID,
+		Node:     nodeName,
+		Network:  network,
+		Cluster:  d.cluster,
+	}
+}
+
+// srvParameters returns the SRV priority and weight of a task's endpoint.
+// The container labels of the service take precedence over node labels,
+// which take precedence over the endpoint specification. Without a task only
+// the endpoint specification applies. The caller must hold the read lock.
+func (d *docker) srvParameters(epSpec *EndpointSpec, task *swarm.Task) (uint16, uint16) {
+	priority := uint16(DefaultPriority)
+	if epSpec.Priority != nil {
+		priority = *epSpec.Priority
+	}
+
+	weight := uint16(DefaultWeight)
+	if epSpec.Weight != nil {
+		weight = *epSpec.Weight
+	}
+
+	if task == nil {
+		return priority, weight
+	}
+
+	overrides := make([]map[string]string, 0, 2)
+	if node, ok := d.nodes[task.NodeID]; ok {
+		overrides = append(overrides, node.Spec.Labels)
+	}
+	if task.Spec.ContainerSpec != nil {
+		overrides = append(overrides, task.Spec.ContainerSpec.Labels)
+	}
+
+	for _, labels := range overrides {
+		priority = parseUint16Label(labels, LabelPriority, priority)
+		weight = parseUint16Label(labels, LabelWeight, weight)
+	}
+
+	return priority, weight
+}
+
+// serviceTtl returns the shortest TTL of all endpoints of a service.
+// The caller must hold the read lock.
+func (d *docker) serviceTtl(serviceId string) uint32 {
+	service, ok := d.services[serviceId]
+	if !ok {
+		return 0
+	}
+
+	var ttl uint32
+	groupSpecs, _ := d.parsedLabels(service.ID)
+	for _, endpointSpecs := range groupSpecs {
+		for _, epSpec := range endpointSpecs {
+			if epSpec.Ttl > 0 && (ttl == 0 || epSpec.Ttl < ttl) {
+				ttl = epSpec.Ttl
+			}
+		}
+	}
+
+	return ttl
+}
+
+// index orders the services by name and their tasks by slot, so the
+// queries of the revision do not have to. The caller must hold the write lock.
+func (d *docker) index() {
+	d.serviceIds = make([]string, 0, len(d.services))
+	for id := range d.services {
+		d.serviceIds = append(d.serviceIds, id)
+	}
+	sort.Slice(d.serviceIds, func(i, j int) bool {
+		si, sj := d.services[d.serviceIds[i]], d.services[d.serviceIds[j]]
+		if si.Spec.Name != sj.Spec.Name {
+			return si.Spec.Name < sj.Spec.Name
+		}
+		return si.ID < sj.ID
+	})
+
+	d.taskIds = make(map[string][]string)
+	for id, task := range d.tasks {
+		d.taskIds[task.ServiceID] = append(d.taskIds[task.ServiceID], id)
+	}
+	for _, ids := range d.taskIds {
+		sort.Slice(ids, func(i, j int) bool {
+			ti, tj := d.tasks[ids[i]], d.tasks[ids[j]]
+			if ti.Slot != tj.Slot {
+				return ti.Slot < tj.Slot
+			}
+			return ti.ID < tj.ID
+		})
+	}
+}
+
+// indexedServices returns the services in the order of the index. Services
+// removed since the last revision are skipped, services added are missing
+// until the next revision. The caller must hold the read lock.
+func (d *docker) indexedServices() []*swarm.Service {
+	services := make([]*swarm.Service, 0, len(d.serviceIds))
+	for _, id := range d.serviceIds {
+		if service, ok := d.services[id]; ok {
+			services = append(services, &service)
+		}
+	}
+
+	return services
+}
+
+// indexedTasks returns the tasks of a service in the order of the index
+// like indexedServices. The caller must hold the read lock.
+func (d *docker) indexedTasks(serviceId string) []*swarm.Task {
+	tasks := make([]*swarm.Task, 0, len(d.taskIds[serviceId]))
+	for _, id := range d.taskIds[serviceId] {
+		if task, ok := d.tasks[id]; ok {
+			tasks = append(tasks, &task)
+		}
+	}
+
+	return tasks
+}
+
+// ---------------------------------------------------------------------------------------
+//  private functions
+// ---------------------------------------------------------------------------------------
+
+// newDocker constructs an empty swarm store with its docker client.
+func newDocker(cluster string, resync time.Duration, ops ...client.Opt) (*docker, error) {
+	d := docker{
+		cluster:    cluster,
+		services:   make(map[string]swarm.Service),
+		tasks:      make(map[string]swarm.Task),
+		networks:   make(map[string]types.NetworkResource),
+		nodes:      make(map[string]swarm.Node),
+		health:     make(map[string]string),
+		converging: make(map[string]bool),
+	}
+
+	d.src = &d
+	d.resync = resync
+
+	var err error
+	d.client, err = client.NewClientWithOpts(ops...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &d, nil
+}
+
+// parseUint16Label returns the value of a numeric label,
+// or the default if the label is missing or invalid.
+func parseUint16Label(labels map[string]string, key string, def uint16) uint16 {
+	str, ok := labels[key]
+	if !ok {
+		return def
+	}
+
+	value, err := strconv.ParseUint(str, 10, 16)
+	if err != nil {
+		logrus.Warnf("invalid value \"%s\" of label \"%s\"", str, key)
+		return def
+	}
+
+	return uint16(value)
+}
+
+// findAttachment returns the attachment of a task to the network referenced
+// by ID, name or the name component of endpoint names. Networks of the
+// service's stack can be referenced without the stack namespace.
+func findAttachment(service *swarm.Service, task *swarm.Task, network string) *swarm.NetworkAttachment {
+	for _, ref := range networkRefs(service, network) {
+		for i, attachment := range task.NetworksAttachments {
+			if attachment.Network.ID == ref ||
+				strings.EqualFold(attachment.Network.Spec.Name, ref) ||
+				strings.EqualFold(networkLabel(attachment.Network.Spec.Name), ref) {
+				return &task.NetworksAttachments[i]
+			}
+		}
+	}
+
+	return nil
+}
+
+// networkRefs returns the names a network reference might denote. Networks
+// of the service's stack can be referenced without the stack namespace.
+func networkRefs(service *swarm.Service, network string) []string {
+	refs := []string{network}
+	if namespace, ok := service.Spec.Labels[labelStackNamespace]; ok {
+		refs = append(refs, namespace+"_"+network)
+	}
+
+	return refs
+}
+
+// hasAddress returns true if the address is assigned to the network attachment.
+func hasAddress(attachment *swarm.NetworkAttachment, ip net.IP) bool {
+	if attachment == nil {
+		return false
+	}
+
+	for _, cidr := range attachment.Addresses {
+		addr, _, err := net.ParseCIDR(cidr)
+		if err == nil && addr.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// networkLabel converts a network name into a valid DNS label.
+func networkLabel(name string) string {
+	return reInvalidLabelChars.ReplaceAllString(name, "-")
 }
@@ -0,0 +1,83 @@
+package store
+
+// swarm-dns-sd
+// Copyright (C) 2020 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/swarm"
+)
+
+// ---------------------------------------------------------------------------------------
+//  tests
+// ---------------------------------------------------------------------------------------
+
+func TestDockerGroupEndpointsOrder(t *testing.T) {
+	d := &docker{
+		services: make(map[string]swarm.Service),
+		tasks:    make(map[string]swarm.Task),
+		networks: map[string]types.NetworkResource{"n1": {ID: "n1", Name: "prom"}},
+	}
+	d.src = d
+
+	labels := map[string]string{LabelGroup + ".mon": `{"node": {"port": 9100, "net": "prom"}}`}
+	for _, name := range []string{"web", "db"} {
+		service := swarm.Service{ID: "s-" + name}
+		service.Spec.Name = name
+		service.Spec.Labels = labels
+		d.services[service.ID] = service
+
+		for _, slot := range []int{3, 1, 2} {
+			task := swarm.Task{ID: fmt.Sprintf("t%d%s", slot, name), ServiceID: service.ID,
+				Slot: slot, NodeID: "node1"}
+			task.Status.State = swarm.TaskStateRunning
+			task.NetworksAttachments = []swarm.NetworkAttachment{{Network: swarm.Network{ID: "n1"}}}
+			task.NetworksAttachments[0].Network.Spec.Name = "prom"
+			d.tasks[task.ID] = task
+		}
+	}
+	d.updateRevision()
+
+	eps, err := d.GetGroupEndpoints("mon")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := make([]string, 0, len(eps))
+	for _, ep := range eps {
+		names = append(names, ep.Name)
+	}
+
+	expected := []string{
+		"node.task-1-t1db.db.node1.prom",
+		"node.task-2-t2db.db.node1.prom",
+		"node.task-3-t3db.db.node1.prom",
+		"node.task-1-t1web.web.node1.prom",
+		"node.task-2-t2web.web.node1.prom",
+		"node.task-3-t3web.web.node1.prom",
+	}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected %v, got %v", expected, names)
+	}
+}
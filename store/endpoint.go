@@ -20,13 +20,52 @@ package store
 //  imports
 // ---------------------------------------------------------------------------------------
 
-import ()
+import (
+	"net"
+)
+
+// ---------------------------------------------------------------------------------------
+//  constants
+// ---------------------------------------------------------------------------------------
+
+const (
+	DefaultPriority = 10
+	DefaultWeight   = 0
+)
 
 // ---------------------------------------------------------------------------------------
 //  types
 // ---------------------------------------------------------------------------------------
 
 type Endpoint struct {
-	Name string
-	Port int
+	Name     string
+	Port     int
+	Ttl      uint32
+	Meta     map[string]string
+	Priority uint16
+	Weight   uint16
+
+	// Vip is set for endpoints on the virtual IP of a service,
+	// they are not bound to a task
+	Vip bool
+
+	// origin of the endpoint
+	SpecName string
+	Service  string
+	Slot     int
+	TaskId   string
+	Node     string
+	Network  string
+
+	// Cluster is the name of the swarm cluster the endpoint
+	// belongs to, it is empty for a single cluster
+	Cluster string
+}
+
+// Addresses holds the IP addresses of a task on a network, split by family.
+// A non-zero Ttl overrides the default TTL of the address records.
+type Addresses struct {
+	IPv4 []net.IP
+	IPv6 []net.IP
+	Ttl  uint32
 }
@@ -16,11 +16,206 @@ package store
 // You should have received a copy of the GNU General Public License
 // along with this program.  If not, see <http://www.gnu.org/licenses/>.
 
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+)
+
+// ---------------------------------------------------------------------------------------
+//  constants
+// ---------------------------------------------------------------------------------------
+
+const (
+	// HealthAll includes all running tasks regardless of their health.
+	HealthAll = "all"
+	// HealthExcludeUnhealthy excludes tasks with an unhealthy container.
+	HealthExcludeUnhealthy = "exclude-unhealthy"
+	// HealthExcludeStarting additionally excludes tasks
+	// whose container healthcheck has not passed yet.
+	HealthExcludeStarting = "exclude-starting"
+
+	// maximum length of a character-string of a TXT record
+	maxTxtStringLength = 255
+)
+
 // ---------------------------------------------------------------------------------------
 //  types
 // ---------------------------------------------------------------------------------------
 
 type EndpointSpec struct {
-	Port    int    `json:"port"`
-	Network string `json:"net"`
+	Port     int               `json:"port"`
+	Network  string            `json:"net"`
+	Ttl      uint32            `json:"ttl"`
+	Meta     map[string]string `json:"meta"`
+	Priority *uint16           `json:"priority"`
+	Weight   *uint16           `json:"weight"`
+	Health   string            `json:"health"`
+	Vip      bool              `json:"vip"`
+}
+
+// ---------------------------------------------------------------------------------------
+//  public functions
+// ---------------------------------------------------------------------------------------
+
+// ParseEndpointSpecs parses the endpoint specifications of a group label.
+func ParseEndpointSpecs(label string) (map[string]*EndpointSpec, error) {
+	var endpointSpecs map[string]*EndpointSpec
+	err := json.Unmarshal([]byte(label), &endpointSpecs)
+	if err != nil {
+		return nil, err
+	}
+
+	for epName, epSpec := range endpointSpecs {
+		if epSpec == nil {
+			return nil, fmt.Errorf("specification of endpoint \"%s\" is empty", epName)
+		}
+	}
+
+	return endpointSpecs, nil
+}
+
+// ---------------------------------------------------------------------------------------
+//  public members
+// ---------------------------------------------------------------------------------------
+
+// AdmitsHealth returns true if a task with the given container health
+// status is included by the health policy of the endpoint. Tasks with an
+// unknown health status or without healthcheck are always included.
+func (e *EndpointSpec) AdmitsHealth(status string) bool {
+	switch e.Health {
+	case HealthExcludeUnhealthy:
+		return status != types.Unhealthy
+	case HealthExcludeStarting:
+		return status != types.Unhealthy && status != types.Starting
+	}
+
+	return true
+}
+
+// Validate checks the specification for values which cannot be served.
+func (e *EndpointSpec) Validate() error {
+	if e.Port < 1 || e.Port > 65535 {
+		return fmt.Errorf("port %d is out of range", e.Port)
+	}
+
+	if e.Network == "" {
+		return fmt.Errorf("network is missing")
+	}
+
+	switch e.Health {
+	case "", HealthAll, HealthExcludeUnhealthy, HealthExcludeStarting:
+	default:
+		return fmt.Errorf("unknown health mode \"%s\"", e.Health)
+	}
+
+	return validateMeta(e.Meta)
+}
+
+// ---------------------------------------------------------------------------------------
+//  private members
+// ---------------------------------------------------------------------------------------
+
+// setField sets a field of the specification from the value of a flat label.
+// True is returned if a different value was set before.
+func (e *EndpointSpec) setField(field string, value string) (bool, error) {
+	switch {
+	case field == "port":
+		port, err := strconv.Atoi(value)
+		if err != nil {
+			return false, fmt.Errorf("invalid port \"%s\"", value)
+		}
+		overridden := e.Port != 0 && e.Port != port
+		e.Port = port
+		return overridden, nil
+
+	case field == "net":
+		overridden := e.Network != "" && e.Network != value
+		e.Network = value
+		return overridden, nil
+
+	case field == "ttl":
+		ttl, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return false, fmt.Errorf("invalid ttl \"%s\"", value)
+		}
+		overridden := e.Ttl != 0 && e.Ttl != uint32(ttl)
+		e.Ttl = uint32(ttl)
+		return overridden, nil
+
+	case field == "priority" || field == "weight":
+		parsed, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return false, fmt.Errorf("invalid %s \"%s\"", field, value)
+		}
+
+		ptr := &e.Priority
+		if field == "weight" {
+			ptr = &e.Weight
+		}
+		overridden := *ptr != nil && **ptr != uint16(parsed)
+		v := uint16(parsed)
+		*ptr = &v
+		return overridden, nil
+
+	case field == "health":
+		overridden := e.Health != "" && e.Health != value
+		e.Health = value
+		return overridden, nil
+
+	case field == "vip":
+		vip, err := strconv.ParseBool(value)
+		if err != nil {
+			return false, fmt.Errorf("invalid vip \"%s\"", value)
+		}
+		overridden := e.Vip && !vip
+		e.Vip = vip
+		return overridden, nil
+
+	case strings.HasPrefix(field, "meta."):
+		key := strings.TrimPrefix(field, "meta.")
+		if e.Meta == nil {
+			e.Meta = make(map[string]string)
+		}
+		old, ok := e.Meta[key]
+		e.Meta[key] = value
+		return ok && old != value, nil
+	}
+
+	return false, fmt.Errorf("%w \"%s\"", errUnknownField, field)
+}
+
+// ---------------------------------------------------------------------------------------
+//  private functions
+// ---------------------------------------------------------------------------------------
+
+// validateMeta checks that each meta entry can be served as "key=value"
+// string of a TXT record, as described by RFC 6763.
+func validateMeta(meta map[string]string) error {
+	keys := make([]string, 0, len(meta))
+	for key := range meta {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		switch {
+		case key == "":
+			return fmt.Errorf("meta key is empty")
+		case strings.Contains(key, "="):
+			return fmt.Errorf("meta key \"%s\" contains \"=\"", key)
+		case len(key)+1+len(meta[key]) > maxTxtStringLength:
+			return fmt.Errorf("meta entry \"%s\" exceeds %d bytes", key, maxTxtStringLength)
+		}
+	}
+
+	return nil
 }
@@ -0,0 +1,55 @@
+package store
+
+// swarm-dns-sd
+// Copyright (C) 2020 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"strings"
+	"testing"
+)
+
+// ---------------------------------------------------------------------------------------
+//  tests
+// ---------------------------------------------------------------------------------------
+
+func TestValidateMeta(t *testing.T) {
+	tests := []struct {
+		name  string
+		meta  map[string]string
+		valid bool
+	}{
+		{"no meta", nil, true},
+		{"entry", map[string]string{"env": "prod"}, true},
+		{"empty value", map[string]string{"env": ""}, true},
+		{"longest entry", map[string]string{"env": strings.Repeat("x", 251)}, true},
+		{"entry too long", map[string]string{"env": strings.Repeat("x", 252)}, false},
+		{"empty key", map[string]string{"": "prod"}, false},
+		{"key with equal sign", map[string]string{"env=prod": "1"}, false},
+	}
+
+	for _, test := range tests {
+		err := validateMeta(test.meta)
+		if test.valid && err != nil {
+			t.Errorf("%s: expected valid, got %s", test.name, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
@@ -0,0 +1,311 @@
+package store
+
+// swarm-dns-sd
+// Copyright (C) 2020 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ---------------------------------------------------------------------------------------
+//  constants
+// ---------------------------------------------------------------------------------------
+
+const (
+	LabelGroup = "kallax.group"
+)
+
+// ---------------------------------------------------------------------------------------
+//  global variables
+// ---------------------------------------------------------------------------------------
+
+var (
+	// unknown fields of flat labels are ignored
+	errUnknownField = errors.New("unknown field")
+
+	// names which are used as component of DNS names
+	reNameComponent = regexp.MustCompile("^[A-Za-z0-9_-]{1,63}$")
+)
+
+// ---------------------------------------------------------------------------------------
+//  types
+// ---------------------------------------------------------------------------------------
+
+// GroupSpecs holds the endpoint specifications of a service by group and endpoint name.
+type GroupSpecs map[string]map[string]*EndpointSpec
+
+// LabelError describes an invalid group label. Warnings
+// do not prevent the group from being used.
+type LabelError struct {
+	Service string
+	Group   string
+	Label   string
+	Message string
+	Warning bool
+}
+
+// ---------------------------------------------------------------------------------------
+//  public functions
+// ---------------------------------------------------------------------------------------
+
+// ParseGroupLabels parses the endpoint specifications of all groups from the
+// labels of a service. A group is either specified by a JSON label
+//
+//	kallax.group.<group>={"<endpoint>": {"port": 9100}}
+//
+// or by flat labels, one per field of the endpoint specification:
+//
+//	kallax.group.<group>.<endpoint>.port=9100
+//	kallax.group.<group>.<endpoint>.meta.<key>=<value>
+//
+// Both forms can be mixed. The flat labels take precedence over the JSON
+// label, a field set to different values in both forms yields a warning.
+// Groups with an invalid JSON label are omitted from the result. Names in DNS
+// are case-insensitive, so group and endpoint names are returned in lower case.
+func ParseGroupLabels(labels map[string]string) (GroupSpecs, []*LabelError) {
+	groups := make(GroupSpecs)
+	errs := make([]*LabelError, 0)
+
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		if strings.HasPrefix(key, LabelGroup+".") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	// the JSON labels are parsed first, as the flat labels override them
+	flat := make([]string, 0)
+	for _, key := range keys {
+		parts := strings.SplitN(strings.TrimPrefix(key, LabelGroup+"."), ".", 3)
+		group := strings.ToLower(parts[0])
+		switch len(parts) {
+		case 1:
+			endpointSpecs, err := ParseEndpointSpecs(labels[key])
+			if err != nil {
+				errs = append(errs, &LabelError{Group: group, Label: key, Message: err.Error()})
+				continue
+			}
+
+			for _, field := range unknownJsonFields(labels[key]) {
+				errs = append(errs, &LabelError{Group: group, Label: key, Warning: true,
+					Message: fmt.Sprintf("%s \"%s\"", errUnknownField.Error(), field)})
+			}
+
+			if groups[group] == nil {
+				groups[group] = make(map[string]*EndpointSpec)
+			}
+			for epName, epSpec := range endpointSpecs {
+				groups[group][strings.ToLower(epName)] = epSpec
+			}
+
+		case 2:
+			errs = append(errs, &LabelError{Group: group, Label: key,
+				Message: "the field of the endpoint is missing"})
+
+		default:
+			flat = append(flat, key)
+		}
+	}
+
+	for _, key := range flat {
+		parts := strings.SplitN(strings.TrimPrefix(key, LabelGroup+"."), ".", 3)
+		group, epName, field := strings.ToLower(parts[0]), strings.ToLower(parts[1]), parts[2]
+
+		// a group with an invalid JSON label stays invalid
+		if hasGroupError(errs, group) {
+			continue
+		}
+
+		if groups[group] == nil {
+			groups[group] = make(map[string]*EndpointSpec)
+		}
+		epSpec, ok := groups[group][epName]
+		if !ok {
+			epSpec = &EndpointSpec{}
+			groups[group][epName] = epSpec
+		}
+
+		overridden, err := epSpec.setField(field, labels[key])
+		if err != nil {
+			errs = append(errs, &LabelError{Group: group, Label: key, Message: err.Error(),
+				Warning: errors.Is(err, errUnknownField)})
+			continue
+		}
+
+		if overridden {
+			errs = append(errs, &LabelError{Group: group, Label: key, Warning: true,
+				Message: "overrides a different value of the JSON label"})
+		}
+	}
+
+	return groups, errs
+}
+
+// ParseServiceLabels parses the group labels of a service and validates the
+// endpoint specifications and the names used in endpoint names. The check is
+// applied to every endpoint specification in addition, it may be nil.
+// Groups with an error are omitted, the remaining groups can be served.
+func ParseServiceLabels(service string, labels map[string]string, check func(*EndpointSpec) error) (GroupSpecs, []*LabelError) {
+	groupSpecs, errs := ParseGroupLabels(labels)
+
+	for _, group := range groupSpecs.sortedGroups() {
+		if !reNameComponent.MatchString(group) {
+			errs = append(errs, &LabelError{Group: group, Label: LabelGroup + "." + group,
+				Message: fmt.Sprintf("group name \"%s\" is not a valid DNS label", group)})
+		}
+
+		if !reNameComponent.MatchString(service) {
+			errs = append(errs, &LabelError{Group: group, Label: LabelGroup + "." + group,
+				Message: fmt.Sprintf("service name \"%s\" is not a valid DNS label", service)})
+		}
+
+		for _, epName := range sortedEndpointNames(groupSpecs[group]) {
+			epSpec := groupSpecs[group][epName]
+			err := epSpec.Validate()
+			if err == nil && !reNameComponent.MatchString(epName) {
+				err = fmt.Errorf("endpoint name is not a valid DNS label")
+			}
+			if err == nil && check != nil {
+				err = check(epSpec)
+			}
+
+			if err != nil {
+				errs = append(errs, &LabelError{Group: group, Label: LabelGroup + "." + group,
+					Message: fmt.Sprintf("endpoint \"%s\": %s", epName, err.Error())})
+			}
+		}
+
+		if hasGroupError(errs, group) {
+			delete(groupSpecs, group)
+		}
+	}
+
+	for _, err := range errs {
+		err.Service = service
+	}
+
+	return groupSpecs, errs
+}
+
+// ---------------------------------------------------------------------------------------
+//  public members
+// ---------------------------------------------------------------------------------------
+
+func (e *LabelError) Error() string {
+	if e.Service != "" {
+		return fmt.Sprintf("service \"%s\": label \"%s\": %s", e.Service, e.Label, e.Message)
+	}
+
+	return fmt.Sprintf("label \"%s\": %s", e.Label, e.Message)
+}
+
+// ---------------------------------------------------------------------------------------
+//  private members
+// ---------------------------------------------------------------------------------------
+
+// sortedGroups returns the names of all groups in alphabetical order.
+// An endpoint name can occur in several groups with a different
+// specification, the first group is taken consistently then.
+func (g GroupSpecs) sortedGroups() []string {
+	groups := make([]string, 0, len(g))
+	for group := range g {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+
+	return groups
+}
+
+// ---------------------------------------------------------------------------------------
+//  private functions
+// ---------------------------------------------------------------------------------------
+
+// unknownJsonFields returns the unknown fields of the endpoint
+// specifications in a JSON label as "<endpoint>.<field>".
+func unknownJsonFields(label string) []string {
+	var endpointSpecs map[string]map[string]json.RawMessage
+	if json.Unmarshal([]byte(label), &endpointSpecs) != nil {
+		return nil
+	}
+
+	fields := make([]string, 0)
+	for epName, epSpec := range endpointSpecs {
+		for field := range epSpec {
+			// encoding/json matches the field names case-insensitively
+			switch strings.ToLower(field) {
+			case "port", "net", "ttl", "meta", "priority", "weight", "health", "vip":
+			default:
+				fields = append(fields, epName+"."+field)
+			}
+		}
+	}
+	sort.Strings(fields)
+
+	return fields
+}
+
+// sortedEndpointNames returns the names of the endpoint specifications
+// in alphabetical order, which is the order the endpoints are served in.
+func sortedEndpointNames(endpointSpecs map[string]*EndpointSpec) []string {
+	epNames := make([]string, 0, len(endpointSpecs))
+	for epName := range endpointSpecs {
+		epNames = append(epNames, epName)
+	}
+	sort.Strings(epNames)
+
+	return epNames
+}
+
+// logLabelErrors logs the label errors which are not part of the previous errors.
+func logLabelErrors(previous []*LabelError, current []*LabelError) {
+	known := make(map[string]bool, len(previous))
+	for _, err := range previous {
+		known[err.Error()] = true
+	}
+
+	for _, err := range current {
+		if known[err.Error()] {
+			continue
+		} else if err.Warning {
+			logrus.Warnln(err.Error())
+		} else {
+			logrus.Errorln(err.Error())
+		}
+	}
+}
+
+// hasGroupError returns true if the group has a label error, which is not a warning.
+func hasGroupError(errs []*LabelError, group string) bool {
+	for _, err := range errs {
+		if err.Group == group && !err.Warning {
+			return true
+		}
+	}
+
+	return false
+}
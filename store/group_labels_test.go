@@ -0,0 +1,154 @@
+package store
+
+// swarm-dns-sd
+// Copyright (C) 2020 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"reflect"
+	"testing"
+)
+
+// ---------------------------------------------------------------------------------------
+//  tests
+// ---------------------------------------------------------------------------------------
+
+func TestParseGroupLabels(t *testing.T) {
+	prio := uint16(20)
+
+	tests := []struct {
+		name   string
+		labels map[string]string
+		groups GroupSpecs
+		errs   []string // "<label>" for errors, "<label> (warning)" for warnings
+	}{
+		{
+			name: "json",
+			labels: map[string]string{
+				"kallax.group.mon": `{"node": {"port": 9100, "net": "prom"}}`,
+				"other.label":      "ignored",
+			},
+			groups: GroupSpecs{"mon": {"node": {Port: 9100, Network: "prom"}}},
+		},
+		{
+			name: "flat",
+			labels: map[string]string{
+				"kallax.group.mon.node.port":     "9100",
+				"kallax.group.mon.node.net":      "prom",
+				"kallax.group.mon.node.meta.env": "prod",
+				"kallax.group.mon.node.priority": "20",
+			},
+			groups: GroupSpecs{"mon": {"node": {Port: 9100, Network: "prom",
+				Meta: map[string]string{"env": "prod"}, Priority: &prio}}},
+		},
+		{
+			name: "flat completes json",
+			labels: map[string]string{
+				"kallax.group.mon":          `{"node": {"port": 9100}}`,
+				"kallax.group.mon.node.net": "prom",
+			},
+			groups: GroupSpecs{"mon": {"node": {Port: 9100, Network: "prom"}}},
+		},
+		{
+			name: "flat overrides json",
+			labels: map[string]string{
+				"kallax.group.mon":           `{"node": {"port": 9100, "net": "prom"}}`,
+				"kallax.group.mon.node.port": "9101",
+				"kallax.group.mon.node.net":  "prom",
+			},
+			groups: GroupSpecs{"mon": {"node": {Port: 9101, Network: "prom"}}},
+			errs:   []string{"kallax.group.mon.node.port (warning)"},
+		},
+		{
+			name: "names in lower case",
+			labels: map[string]string{
+				"kallax.group.Mon":           `{"Node": {"port": 9100, "net": "prom"}}`,
+				"kallax.group.MON.NODE.net":  "Prom",
+				"kallax.group.Web.Http.port": "80",
+			},
+			groups: GroupSpecs{
+				"mon": {"node": {Port: 9100, Network: "Prom"}},
+				"web": {"http": {Port: 80}},
+			},
+			errs: []string{"kallax.group.MON.NODE.net (warning)"},
+		},
+		{
+			name: "invalid json omits group",
+			labels: map[string]string{
+				"kallax.group.mon":           `{"node": `,
+				"kallax.group.mon.node.port": "9100",
+				"kallax.group.web":           `{"http": {"port": 80, "net": "web"}}`,
+			},
+			groups: GroupSpecs{"web": {"http": {Port: 80, Network: "web"}}},
+			errs:   []string{"kallax.group.mon"},
+		},
+		{
+			name: "unknown fields",
+			labels: map[string]string{
+				"kallax.group.mon":            `{"node": {"port": 9100, "net": "prom", "prot": "tcp"}}`,
+				"kallax.group.mon.node.proto": "tcp",
+			},
+			groups: GroupSpecs{"mon": {"node": {Port: 9100, Network: "prom"}}},
+			errs: []string{
+				"kallax.group.mon (warning)",
+				"kallax.group.mon.node.proto (warning)",
+			},
+		},
+		{
+			name: "invalid flat value",
+			labels: map[string]string{
+				"kallax.group.mon.node.port": "http",
+				"kallax.group.mon.node.net":  "prom",
+			},
+			groups: GroupSpecs{"mon": {"node": {Network: "prom"}}},
+			errs:   []string{"kallax.group.mon.node.port"},
+		},
+		{
+			name: "missing field omits group",
+			labels: map[string]string{
+				"kallax.group.mon.node":      "9100",
+				"kallax.group.mon.node.port": "9100",
+			},
+			groups: GroupSpecs{},
+			errs:   []string{"kallax.group.mon.node"},
+		},
+	}
+
+	for _, test := range tests {
+		groups, errs := ParseGroupLabels(test.labels)
+		if !reflect.DeepEqual(groups, test.groups) {
+			t.Errorf("%s: expected groups %v, got %v", test.name, test.groups, groups)
+		}
+
+		labels := make([]string, 0)
+		for _, err := range errs {
+			if err.Warning {
+				labels = append(labels, err.Label+" (warning)")
+			} else {
+				labels = append(labels, err.Label)
+			}
+		}
+		if len(test.errs) < 1 {
+			test.errs = []string{}
+		}
+		if !reflect.DeepEqual(labels, test.errs) {
+			t.Errorf("%s: expected errors %v, got %v", test.name, test.errs, errs)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package store
+
+// swarm-dns-sd
+// Copyright (C) 2020 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	"github.com/sirupsen/logrus"
+)
+
+// ---------------------------------------------------------------------------------------
+//  constants
+// ---------------------------------------------------------------------------------------
+
+const (
+	// time to wait before reconnecting to the docker event stream
+	eventsRetryDelay = 5 * time.Second
+)
+
+// ---------------------------------------------------------------------------------------
+//  types
+// ---------------------------------------------------------------------------------------
+
+// source is the docker state an in-memory snapshot is built from.
+type source interface {
+	// sync replaces the snapshot with the current docker state.
+	sync() error
+
+	// handleEvent applies a single docker event to the snapshot.
+	handleEvent(msg *events.Message) error
+
+	// stateFingerprint returns a hash of the content of the snapshot.
+	// The caller must hold the read lock.
+	stateFingerprint() uint64
+
+	// index orders the snapshot for the queries of a new
+	// revision. The caller must hold the write lock.
+	index()
+
+	// parseLabels returns the group labels of all services in the order
+	// their errors are reported. The caller must hold the read lock.
+	parseLabels() []*serviceLabels
+}
+
+// serviceLabels are the parsed group labels of a service or container.
+type serviceLabels struct {
+	id         string
+	groupSpecs GroupSpecs
+	errs       []*LabelError
+}
+
+// snapshot holds the state shared by the stores which keep an in-memory
+// snapshot of docker up to date by the event stream and periodic resyncs.
+type snapshot struct {
+	src    source
+	client *client.Client
+	resync time.Duration
+
+	mutex sync.RWMutex
+
+	// revision is incremented when the fingerprint of the snapshot changes
+	fingerprint uint64
+	revision    uint64
+
+	// parsed group labels by service ID and their
+	// errors as of the current revision
+	labels      map[string]*serviceLabels
+	labelErrors []*LabelError
+
+	// last error of the synchronization with docker
+	syncErr error
+}
+
+// ---------------------------------------------------------------------------------------
+//  public members
+// ---------------------------------------------------------------------------------------
+
+// GetGroups returns the names of all groups in alphabetical order.
+func (s *snapshot) GetGroups() ([]string, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	groups := make([]string, 0)
+	seen := make(map[string]bool)
+	add := func(group string) {
+		if !seen[group] {
+			seen[group] = true
+			groups = append(groups, group)
+		}
+	}
+
+	for _, labels := range s.labels {
+		for group := range labels.groupSpecs {
+			add(group)
+		}
+
+		// groups whose labels are invalid exist nevertheless
+		for _, err := range labels.errs {
+			add(err.Group)
+		}
+	}
+	sort.Strings(groups)
+
+	return groups, nil
+}
+
+// GetLabelErrors returns the errors of all invalid group labels.
+func (s *snapshot) GetLabelErrors() ([]*LabelError, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return append([]*LabelError{}, s.labelErrors...), nil
+}
+
+// GetRevision returns the revision of the in-memory snapshot.
+func (s *snapshot) GetRevision() uint64 {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.revision
+}
+
+// ---------------------------------------------------------------------------------------
+//  private members
+// ---------------------------------------------------------------------------------------
+
+// watch keeps the in-memory snapshot up to date by processing
+// the docker events matching the filter and periodic resyncs.
+func (s *snapshot) watch(filter filters.Args) {
+	for {
+		ctx, cancel := context.WithCancel(context.Background())
+		messages, errs := s.client.Events(ctx, types.EventsOptions{Filters: filter})
+		resync := time.NewTicker(s.resync)
+
+	loop:
+		for {
+			select {
+			case msg := <-messages:
+				err := s.src.handleEvent(&msg)
+				if err != nil {
+					logrus.Errorf("failed to handle %s event: %s", msg.Type, err.Error())
+				}
+
+				s.mutex.Lock()
+				s.updateRevision()
+				s.mutex.Unlock()
+
+			case <-resync.C:
+				s.resyncState()
+
+			case err := <-errs:
+				logrus.Errorln("docker event stream failed:", err.Error())
+				s.setSyncErr(err)
+				break loop
+			}
+		}
+
+		resync.Stop()
+		cancel()
+
+		// events might have been missed while the stream was down
+		time.Sleep(eventsRetryDelay)
+		s.resyncState()
+	}
+}
+
+// resyncState replaces the snapshot with the current docker state
+// and records the result.
+func (s *snapshot) resyncState() {
+	err := s.src.sync()
+	if err != nil {
+		logrus.Errorln("failed to resync docker state:", err.Error())
+	}
+	s.setSyncErr(err)
+}
+
+// setSyncErr records the result of the last synchronization.
+func (s *snapshot) setSyncErr(err error) {
+	s.mutex.Lock()
+	s.syncErr = err
+	s.mutex.Unlock()
+}
+
+// parsedLabels returns the group labels of a service as of the current
+// revision. They are shared and must not be modified. The caller must
+// hold the read lock.
+func (s *snapshot) parsedLabels(id string) (GroupSpecs, []*LabelError) {
+	labels, ok := s.labels[id]
+	if !ok {
+		return GroupSpecs{}, nil
+	}
+
+	return labels.groupSpecs, labels.errs
+}
+
+// updateRevision increments the revision if the content of the snapshot
+// has changed since the last call. The snapshot is indexed and the group
+// labels are parsed only then, so queries do not have to sort the snapshot
+// or parse the labels. New label errors are logged.
+// The caller must hold the write lock.
+func (s *snapshot) updateRevision() {
+	fingerprint := s.src.stateFingerprint()
+	if fingerprint == s.fingerprint {
+		return
+	}
+	s.fingerprint = fingerprint
+	s.revision++
+	s.src.index()
+
+	s.labels = make(map[string]*serviceLabels)
+	labelErrors := make([]*LabelError, 0)
+	for _, labels := range s.src.parseLabels() {
+		s.labels[labels.id] = labels
+		labelErrors = append(labelErrors, labels.errs...)
+	}
+
+	logLabelErrors(s.labelErrors, labelErrors)
+	s.labelErrors = labelErrors
+}
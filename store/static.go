@@ -0,0 +1,479 @@
+package store
+
+// swarm-dns-sd
+// Copyright (C) 2020 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// ---------------------------------------------------------------------------------------
+//  constants
+// ---------------------------------------------------------------------------------------
+
+const (
+	// service and network component of the endpoint names of static endpoints
+	staticService = "static"
+	staticNetwork = "static"
+
+	// slot of all static endpoints, the name identifies the host within
+	// a group, so the endpoint names do not depend on the order of the file
+	staticSlot = 1
+
+	// files are reloaded once they have not been written for this long
+	staticReloadDelay = 250 * time.Millisecond
+)
+
+// ---------------------------------------------------------------------------------------
+//  types
+// ---------------------------------------------------------------------------------------
+
+type static struct {
+	path string
+
+	// groups of the last successfully loaded file
+	mutex       sync.RWMutex
+	groups      map[string][]*StaticEndpoint
+	fingerprint uint64
+	revision    uint64
+
+	// last error of loading the file
+	loadErr error
+}
+
+// StaticFile is the content of the file of a static store.
+type StaticFile struct {
+	Groups map[string][]*StaticEndpoint `yaml:"groups"`
+}
+
+// StaticEndpoint is an endpoint of a group in the file of a static store.
+// The name identifies the host, it must be a valid DNS label.
+type StaticEndpoint struct {
+	Name      string            `yaml:"name"`
+	Addresses []string          `yaml:"addresses"`
+	Port      int               `yaml:"port"`
+	Ttl       uint32            `yaml:"ttl"`
+	Meta      map[string]string `yaml:"meta"`
+	Priority  *uint16           `yaml:"priority"`
+	Weight    *uint16           `yaml:"weight"`
+}
+
+// ---------------------------------------------------------------------------------------
+//  public functions
+// ---------------------------------------------------------------------------------------
+
+// NewStatic constructs a new Store backed by a YAML or JSON file, which
+// lists the endpoints of each group. The file is reloaded whenever it
+// changes, an invalid file is reported and the previous content is kept.
+func NewStatic(path string) (Store, error) {
+	s := static{path: path}
+
+	err := s.load()
+	if err != nil {
+		return nil, err
+	}
+
+	// editors and config management replace files instead of
+	// writing them, so the directory is watched
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	err = watcher.Add(filepath.Dir(path))
+	if err != nil {
+		_ = watcher.Close()
+		return nil, err
+	}
+
+	go s.watch(watcher)
+
+	return &s, nil
+}
+
+// ParseStaticFile parses and validates the content of a static store's file.
+func ParseStaticFile(content []byte) (*StaticFile, error) {
+	var file StaticFile
+	err := yaml.UnmarshalStrict(content, &file)
+	if err != nil {
+		return nil, err
+	}
+
+	// an empty file is most likely written right now
+	if file.Groups == nil {
+		return nil, fmt.Errorf("groups are missing")
+	}
+
+	// names in DNS are case-insensitive, they are served in lower case
+	groups := make(map[string][]*StaticEndpoint, len(file.Groups))
+	for group, endpoints := range file.Groups {
+		group = strings.ToLower(group)
+		if _, ok := groups[group]; ok {
+			return nil, fmt.Errorf("group \"%s\" is listed twice", group)
+		}
+
+		for _, ep := range endpoints {
+			if ep != nil {
+				ep.Name = strings.ToLower(ep.Name)
+			}
+		}
+		groups[group] = endpoints
+	}
+	file.Groups = groups
+
+	// the addresses of a host are the same in all groups
+	addrs := make(map[string]string)
+	for group, endpoints := range file.Groups {
+		if !reNameComponent.MatchString(group) {
+			return nil, fmt.Errorf("group name \"%s\" is not a valid DNS label", group)
+		}
+
+		names := make(map[string]bool)
+		for _, ep := range endpoints {
+			if ep == nil || !reNameComponent.MatchString(ep.Name) {
+				return nil, fmt.Errorf("group \"%s\": endpoint name is not a valid DNS label", group)
+			}
+
+			if names[ep.Name] {
+				return nil, fmt.Errorf("group \"%s\": endpoint \"%s\" is listed twice", group, ep.Name)
+			}
+			names[ep.Name] = true
+
+			if ep.Port < 1 || ep.Port > 65535 {
+				return nil, fmt.Errorf("group \"%s\": endpoint \"%s\": port %d is out of range",
+					group, ep.Name, ep.Port)
+			}
+
+			if len(ep.Addresses) < 1 {
+				return nil, fmt.Errorf("group \"%s\": endpoint \"%s\": addresses are missing",
+					group, ep.Name)
+			}
+
+			for _, addr := range ep.Addresses {
+				if net.ParseIP(addr) == nil {
+					return nil, fmt.Errorf("group \"%s\": endpoint \"%s\": invalid address \"%s\"",
+						group, ep.Name, addr)
+				}
+			}
+
+			if err := validateMeta(ep.Meta); err != nil {
+				return nil, fmt.Errorf("group \"%s\": endpoint \"%s\": %w", group, ep.Name, err)
+			}
+
+			key := fmt.Sprint(ep.Addresses)
+			if other, ok := addrs[ep.Name]; ok && other != key {
+				return nil, fmt.Errorf("group \"%s\": endpoint \"%s\" has different addresses in another group",
+					group, ep.Name)
+			}
+			addrs[ep.Name] = key
+		}
+	}
+
+	return &file, nil
+}
+
+// ---------------------------------------------------------------------------------------
+//  public members
+// ---------------------------------------------------------------------------------------
+
+// GetGroups returns the names of all groups in alphabetical order.
+func (s *static) GetGroups() ([]string, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	groups := make([]string, 0, len(s.groups))
+	for group := range s.groups {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+
+	return groups, nil
+}
+
+// GetGroupEndpoints returns all Endpoints which belong to the given group.
+func (s *static) GetGroupEndpoints(group string) ([]*Endpoint, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	endpoints, ok := s.groups[group]
+	if !ok {
+		return nil, fmt.Errorf("%w: group \"%s\"", ErrNotFound, group)
+	}
+
+	eps := make([]*Endpoint, 0, len(endpoints))
+	for _, ep := range endpoints {
+		eps = append(eps, makeStaticEndpoint(group, ep))
+	}
+
+	return eps, nil
+}
+
+// GetTaskEndpoints returns the Endpoints of a host in all groups.
+// Hosts are referenced by their name.
+func (s *static) GetTaskEndpoints(taskId string) ([]*Endpoint, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	eps := make([]*Endpoint, 0)
+	for _, group := range s.sortedGroups() {
+		for _, ep := range s.groups[group] {
+			if ep.Name == taskId {
+				eps = append(eps, makeStaticEndpoint(group, ep))
+			}
+		}
+	}
+
+	if len(eps) < 1 {
+		return nil, fmt.Errorf("%w: endpoint \"%s\"", ErrNotFound, taskId)
+	}
+
+	return eps, nil
+}
+
+// GetTaskIpAddresses returns the IP addresses of a host.
+// Static endpoints are only reachable on the "static" network.
+func (s *static) GetTaskIpAddresses(taskId string, network string) (*Addresses, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if network != staticNetwork {
+		return nil, fmt.Errorf("%w: network \"%s\"", ErrNotFound, network)
+	}
+
+	var addrs *Addresses
+	for _, group := range s.sortedGroups() {
+		for _, ep := range s.groups[group] {
+			if ep.Name != taskId {
+				continue
+			}
+
+			if addrs == nil {
+				addrs = &Addresses{Ttl: ep.Ttl}
+				for _, addr := range ep.Addresses {
+					ip := net.ParseIP(addr)
+					if ip.To4() != nil {
+						addrs.IPv4 = append(addrs.IPv4, ip.To4())
+					} else {
+						addrs.IPv6 = append(addrs.IPv6, ip)
+					}
+				}
+			}
+
+			// the shortest TTL applies to the addresses
+			if ep.Ttl > 0 && (addrs.Ttl == 0 || ep.Ttl < addrs.Ttl) {
+				addrs.Ttl = ep.Ttl
+			}
+		}
+	}
+
+	if addrs == nil {
+		return nil, fmt.Errorf("%w: endpoint \"%s\"", ErrNotFound, taskId)
+	}
+
+	return addrs, nil
+}
+
+// GetVirtualIpAddresses always fails, as static endpoints have no virtual IPs.
+func (s *static) GetVirtualIpAddresses(cluster string, service string, epName string, network string) (*Addresses, error) {
+	return nil, fmt.Errorf("%w: service \"%s\" has no virtual IP", ErrNotFound, service)
+}
+
+// GetVirtualIpEndpoints always fails, as static endpoints have no virtual IPs.
+func (s *static) GetVirtualIpEndpoints(cluster string, service string) ([]*Endpoint, error) {
+	return nil, fmt.Errorf("%w: service \"%s\" has no virtual IP", ErrNotFound, service)
+}
+
+// GetAddressEndpoints returns all Endpoints of the host the address is assigned to.
+func (s *static) GetAddressEndpoints(ip net.IP) ([]*Endpoint, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	eps := make([]*Endpoint, 0)
+	for _, group := range s.sortedGroups() {
+		for _, ep := range s.groups[group] {
+			for _, addr := range ep.Addresses {
+				if ip.Equal(net.ParseIP(addr)) {
+					eps = append(eps, makeStaticEndpoint(group, ep))
+					break
+				}
+			}
+		}
+	}
+
+	if len(eps) < 1 {
+		return nil, fmt.Errorf("%w: address \"%s\"", ErrNotFound, ip)
+	}
+
+	return eps, nil
+}
+
+// GetLabelErrors returns no errors, as static endpoints have no labels.
+// Errors in the file are logged when it is loaded.
+func (s *static) GetLabelErrors() ([]*LabelError, error) {
+	return []*LabelError{}, nil
+}
+
+// GetRevision returns the revision of the loaded file.
+func (s *static) GetRevision() uint64 {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.revision
+}
+
+// GetHealth reports the static store unhealthy while the file is invalid.
+func (s *static) GetHealth() []*BackendHealth {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return []*BackendHealth{makeBackendHealth("static", s.loadErr)}
+}
+
+// ---------------------------------------------------------------------------------------
+//  private members
+// ---------------------------------------------------------------------------------------
+
+// load reads the file and replaces the groups if it is valid.
+func (s *static) load() error {
+	content, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+
+	file, err := ParseStaticFile(content)
+	if err != nil {
+		return fmt.Errorf("%s: %w", s.path, err)
+	}
+
+	h := fnv.New64a()
+	_, _ = h.Write(content)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.groups = file.Groups
+
+	if h.Sum64() != s.fingerprint {
+		s.fingerprint = h.Sum64()
+		s.revision++
+	}
+
+	logrus.Debugf("loaded %d static groups from %s", len(s.groups), s.path)
+
+	return nil
+}
+
+// watch reloads the file whenever it is written, created or replaced.
+func (s *static) watch(watcher *fsnotify.Watcher) {
+	defer watcher.Close()
+
+	reload := time.NewTimer(staticReloadDelay)
+	reload.Stop()
+
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+
+			if filepath.Clean(event.Name) != filepath.Clean(s.path) ||
+				event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+				continue
+			}
+
+			// wait for the writer to finish
+			reload.Reset(staticReloadDelay)
+
+		case <-reload.C:
+			err := s.load()
+			if err != nil {
+				logrus.Errorln("failed to reload static endpoints:", err.Error())
+			}
+
+			s.mutex.Lock()
+			s.loadErr = err
+			s.mutex.Unlock()
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			logrus.Errorln("failed to watch static endpoints:", err.Error())
+		}
+	}
+}
+
+// sortedGroups returns the names of all groups in alphabetical order.
+// The caller must hold the read lock.
+func (s *static) sortedGroups() []string {
+	groups := make([]string, 0, len(s.groups))
+	for group := range s.groups {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+
+	return groups
+}
+
+// ---------------------------------------------------------------------------------------
+//  private functions
+// ---------------------------------------------------------------------------------------
+
+// makeStaticEndpoint constructs the Endpoint of a host in a group.
+func makeStaticEndpoint(group string, ep *StaticEndpoint) *Endpoint {
+	priority := uint16(DefaultPriority)
+	if ep.Priority != nil {
+		priority = *ep.Priority
+	}
+
+	weight := uint16(DefaultWeight)
+	if ep.Weight != nil {
+		weight = *ep.Weight
+	}
+
+	return &Endpoint{
+		Name: fmt.Sprintf("%s.task-%d-%s.%s.%s.%s",
+			group, staticSlot, ep.Name, staticService, ep.Name, staticNetwork),
+		Port:     ep.Port,
+		Ttl:      ep.Ttl,
+		Meta:     ep.Meta,
+		Priority: priority,
+		Weight:   weight,
+		SpecName: group,
+		Service:  staticService,
+		Slot:     staticSlot,
+		TaskId:   ep.Name,
+		Node:     ep.Name,
+		Network:  staticNetwork,
+	}
+}
@@ -16,11 +16,74 @@ package store
 // You should have received a copy of the GNU General Public License
 // along with this program.  If not, see <http://www.gnu.org/licenses/>.
 
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"errors"
+	"net"
+)
+
+// ---------------------------------------------------------------------------------------
+//  global variables
+// ---------------------------------------------------------------------------------------
+
+var (
+	// ErrNotFound is returned when the requested group, task,
+	// network attachment or address does not exist.
+	ErrNotFound = errors.New("not found")
+)
+
 // ---------------------------------------------------------------------------------------
 //  types
 // ---------------------------------------------------------------------------------------
 
 type Store interface {
+	GetGroups() ([]string, error)
 	GetGroupEndpoints(group string) ([]*Endpoint, error)
-	GetTaskIpAddresses(taskId string, networkId string) (string, error)
+	GetTaskEndpoints(taskId string) ([]*Endpoint, error)
+	GetTaskIpAddresses(taskId string, networkId string) (*Addresses, error)
+
+	// GetVirtualIpAddresses returns the virtual IP addresses of a service
+	// in the given cluster, which is empty for stores of a single cluster.
+	GetVirtualIpAddresses(cluster string, service string, epName string, network string) (*Addresses, error)
+
+	// GetVirtualIpEndpoints returns the Endpoints on the virtual IP
+	// of a service in the given cluster in all groups.
+	GetVirtualIpEndpoints(cluster string, service string) ([]*Endpoint, error)
+
+	GetAddressEndpoints(ip net.IP) ([]*Endpoint, error)
+
+	// GetLabelErrors returns the errors of all invalid group labels.
+	// Services with invalid labels are omitted from their group.
+	GetLabelErrors() ([]*LabelError, error)
+
+	// GetRevision returns a counter which is incremented
+	// whenever the content of the store changes.
+	GetRevision() uint64
+
+	// GetHealth returns the health of the sources of the store.
+	GetHealth() []*BackendHealth
+}
+
+// BackendHealth is the health of a source of endpoints. An unhealthy
+// source might still serve endpoints, but they can be outdated.
+type BackendHealth struct {
+	Backend string
+	Healthy bool
+	Message string
+}
+
+// ---------------------------------------------------------------------------------------
+//  private functions
+// ---------------------------------------------------------------------------------------
+
+// makeBackendHealth returns the health of a backend with the given last error.
+func makeBackendHealth(backend string, err error) *BackendHealth {
+	if err != nil {
+		return &BackendHealth{Backend: backend, Message: err.Error()}
+	}
+
+	return &BackendHealth{Backend: backend, Healthy: true, Message: "ok"}
 }
@@ -0,0 +1,295 @@
+package main
+
+// swarm-dns-sd
+// Copyright (C) 2020 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types/swarm"
+	"gopkg.in/yaml.v2"
+
+	"github.com/faryon93/kallax/store"
+)
+
+// ---------------------------------------------------------------------------------------
+//  types
+// ---------------------------------------------------------------------------------------
+
+// composeFile is the part of a compose or stack file kallax is interested in.
+type composeFile struct {
+	Services map[string]composeService `yaml:"services"`
+	Networks map[string]*struct {
+		Name string `yaml:"name"`
+	} `yaml:"networks"`
+}
+
+type composeService struct {
+	Labels composeLabels `yaml:"labels"`
+	Deploy struct {
+		Labels       composeLabels `yaml:"labels"`
+		EndpointMode string        `yaml:"endpoint_mode"`
+	} `yaml:"deploy"`
+	Networks composeNetworks `yaml:"networks"`
+}
+
+// composeLabels are labels in either the map or the "key=value" list syntax.
+type composeLabels map[string]string
+
+// composeNetworks are the network names of a service in either the map or list syntax.
+type composeNetworks []string
+
+// ---------------------------------------------------------------------------------------
+//  public functions
+// ---------------------------------------------------------------------------------------
+
+// Validate checks the group labels of the services in compose files or
+// the output of "docker service inspect" and returns the exit code.
+func Validate(args []string) int {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	stack := flags.String("stack", "", "stack or compose project name the compose files are deployed as")
+	strict := flags.Bool("strict", false, "fail on warnings")
+	mode := flags.String("mode", ModeSwarm, "mode the compose files are read in: swarm, container")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: kallax validate [flags] <file|-> ...")
+		fmt.Fprintln(flags.Output(), "checks the kallax labels of compose files and \"docker service inspect\" output")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	if flags.NArg() < 1 || (*mode != ModeSwarm && *mode != ModeContainer) {
+		flags.Usage()
+		return 2
+	}
+
+	failed := false
+	for _, path := range flags.Args() {
+		errs, err := validateFile(path, *stack, *mode)
+		if err != nil {
+			fmt.Printf("%s: error: %s\n", path, err.Error())
+			failed = true
+			continue
+		}
+
+		for _, err := range errs {
+			severity := "error"
+			if err.Warning {
+				severity = "warning"
+			}
+			fmt.Printf("%s: %s: %s\n", path, severity, err.Error())
+
+			failed = failed || !err.Warning || *strict
+		}
+	}
+
+	if failed {
+		return 1
+	}
+
+	return 0
+}
+
+// ---------------------------------------------------------------------------------------
+//  public members
+// ---------------------------------------------------------------------------------------
+
+// UnmarshalYAML accepts the map and the "key=value" list syntax.
+func (l *composeLabels) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var list []string
+	if unmarshal(&list) == nil {
+		*l = make(composeLabels, len(list))
+		for _, entry := range list {
+			parts := strings.SplitN(entry, "=", 2)
+			if len(parts) < 2 {
+				parts = append(parts, "")
+			}
+			(*l)[parts[0]] = parts[1]
+		}
+		return nil
+	}
+
+	// unquoted values like ports are no strings in YAML
+	var values map[string]interface{}
+	err := unmarshal(&values)
+	if err != nil {
+		return err
+	}
+
+	*l = make(composeLabels, len(values))
+	for key, value := range values {
+		if value == nil {
+			value = ""
+		}
+		(*l)[key] = fmt.Sprint(value)
+	}
+
+	return nil
+}
+
+// UnmarshalYAML accepts the map and the list syntax.
+func (n *composeNetworks) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var list []string
+	if unmarshal(&list) == nil {
+		*n = list
+		return nil
+	}
+
+	var values map[string]interface{}
+	err := unmarshal(&values)
+	if err != nil {
+		return err
+	}
+
+	*n = make(composeNetworks, 0, len(values))
+	for name := range values {
+		*n = append(*n, name)
+	}
+	sort.Strings(*n)
+
+	return nil
+}
+
+// ---------------------------------------------------------------------------------------
+//  private functions
+// ---------------------------------------------------------------------------------------
+
+// validateFile checks the group labels of all services in a file.
+// JSON arrays are treated as output of "docker service inspect".
+func validateFile(path string, stack string, mode string) ([]*store.LabelError, error) {
+	var content []byte
+	var err error
+	if path == "-" {
+		content, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		content, err = ioutil.ReadFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.HasPrefix(bytes.TrimSpace(content), []byte("[")) {
+		return validateInspect(content)
+	}
+
+	return validateCompose(content, stack, mode)
+}
+
+// validateInspect checks the services of "docker service inspect".
+// The networks are referenced by ID, so they are not checked.
+func validateInspect(content []byte) ([]*store.LabelError, error) {
+	var services []swarm.Service
+	err := json.Unmarshal(content, &services)
+	if err != nil {
+		return nil, err
+	}
+
+	errs := make([]*store.LabelError, 0)
+	for _, service := range services {
+		_, serviceErrs := store.ParseServiceLabels(service.Spec.Name, service.Spec.Labels, nil)
+		errs = append(errs, serviceErrs...)
+	}
+
+	return errs, nil
+}
+
+// validateCompose checks the services of a compose or stack file. In swarm
+// mode the group labels are read from "deploy.labels", in container mode
+// from the container labels.
+func validateCompose(content []byte, stack string, mode string) ([]*store.LabelError, error) {
+	var compose composeFile
+	err := yaml.Unmarshal(content, &compose)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(compose.Services))
+	for name := range compose.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	errs := make([]*store.LabelError, 0)
+	for _, name := range names {
+		service := compose.Services[name]
+		serviceName := name
+		if stack != "" {
+			serviceName = stack + "_" + name
+		}
+
+		// services without networks are attached to the default network
+		networks := service.Networks
+		if len(networks) < 1 {
+			networks = composeNetworks{"default"}
+		}
+
+		labels, ignored := service.Deploy.Labels, service.Labels
+		ignoredMessage := "container labels are ignored in swarm mode, use \"deploy.labels\""
+		if mode == ModeContainer {
+			labels, ignored = service.Labels, service.Deploy.Labels
+			ignoredMessage = "deploy labels are ignored in container mode, use \"labels\""
+		}
+
+		_, serviceErrs := store.ParseServiceLabels(serviceName, labels, func(epSpec *store.EndpointSpec) error {
+			if epSpec.Vip && mode == ModeContainer {
+				return fmt.Errorf("containers have no virtual IP")
+			}
+
+			if epSpec.Vip && service.Deploy.EndpointMode == "dnsrr" {
+				return fmt.Errorf("the service has no virtual IP in endpoint mode \"dnsrr\"")
+			}
+
+			for _, network := range networks {
+				if epSpec.Network == network || (stack != "" && epSpec.Network == stack+"_"+network) {
+					return nil
+				}
+
+				// external networks are referenced by their actual name
+				if spec := compose.Networks[network]; spec != nil && spec.Name == epSpec.Network {
+					return nil
+				}
+			}
+			return fmt.Errorf("service is not attached to network \"%s\"", epSpec.Network)
+		})
+		errs = append(errs, serviceErrs...)
+
+		// group labels of the other mode are not evaluated
+		keys := make([]string, 0)
+		for key := range ignored {
+			if strings.HasPrefix(key, store.LabelGroup+".") {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			errs = append(errs, &store.LabelError{Service: serviceName, Label: key, Warning: true,
+				Message: ignoredMessage})
+		}
+	}
+
+	return errs, nil
+}
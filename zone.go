@@ -0,0 +1,273 @@
+package main
+
+// swarm-dns-sd
+// Copyright (C) 2020 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"github.com/faryon93/kallax/store"
+)
+
+// ---------------------------------------------------------------------------------------
+//  types
+// ---------------------------------------------------------------------------------------
+
+// Zone is a DNS zone kallax is authoritative for.
+type Zone struct {
+	Name        string
+	NameServers []*NameServer
+	Hostmaster  string
+
+	// Subnet is the address range of a reverse zone,
+	// it is nil for all forward zones.
+	Subnet *net.IPNet
+}
+
+// NameServer is an authoritative name server of the zone.
+// Name servers within the zone are resolved to their addresses.
+type NameServer struct {
+	Name  string
+	Addrs store.Addresses
+}
+
+// ---------------------------------------------------------------------------------------
+//  public functions
+// ---------------------------------------------------------------------------------------
+
+// NewZone constructs a new zone. Without name servers "ns.<zone>"
+// is used, an empty hostmaster defaults to "hostmaster.<zone>".
+func NewZone(name string, nameServers []*NameServer, hostmaster string) (*Zone, error) {
+	name = dns.Fqdn(strings.ToLower(strings.TrimSpace(name)))
+	if _, ok := dns.IsDomainName(name); !ok || name == "." {
+		return nil, fmt.Errorf("invalid zone name \"%s\"", name)
+	}
+
+	if len(nameServers) < 1 {
+		nameServers = []*NameServer{{Name: "ns." + name}}
+	}
+
+	if hostmaster == "" {
+		hostmaster = "hostmaster." + name
+	}
+
+	return &Zone{
+		Name:        name,
+		NameServers: nameServers,
+		Hostmaster:  dns.Fqdn(hostmaster),
+	}, nil
+}
+
+// ParseZones parses a comma separated list of zone names.
+// All zones share the given name servers and hostmaster.
+func ParseZones(str string, nameServers []*NameServer, hostmaster string) ([]*Zone, error) {
+	zones := make([]*Zone, 0)
+	for _, name := range strings.Split(str, ",") {
+		if strings.TrimSpace(name) == "" {
+			continue
+		}
+
+		zone, err := NewZone(name, nameServers, hostmaster)
+		if err != nil {
+			return nil, err
+		}
+		zones = append(zones, zone)
+	}
+
+	if len(zones) < 1 {
+		return nil, fmt.Errorf("at least one zone is required")
+	}
+
+	return zones, nil
+}
+
+// ParseReverseZones parses a comma separated list of subnets and constructs
+// the reverse zones covering them. Subnets which do not end on an octet
+// (IPv4) or nibble (IPv6) boundary are split into multiple zones.
+func ParseReverseZones(str string, nameServers []*NameServer, hostmaster string) ([]*Zone, error) {
+	zones := make([]*Zone, 0)
+	for _, cidr := range strings.Split(str, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+
+		_, subnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, name := range reverseZoneNames(subnet) {
+			zone, err := NewZone(name, nameServers, hostmaster)
+			if err != nil {
+				return nil, err
+			}
+			zone.Subnet = subnet
+			zones = append(zones, zone)
+		}
+	}
+
+	return zones, nil
+}
+
+// ParseNameServers parses a comma separated list of name servers.
+// Each entry is a host name with an optional address: "host[=ip]".
+// Multiple entries with the same host name are merged.
+func ParseNameServers(str string) ([]*NameServer, error) {
+	nameServers := make([]*NameServer, 0)
+	byName := make(map[string]*NameServer)
+
+	for _, entry := range strings.Split(str, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+		name := dns.Fqdn(strings.ToLower(parts[0]))
+		if _, ok := dns.IsDomainName(name); !ok {
+			return nil, fmt.Errorf("invalid name server \"%s\"", parts[0])
+		}
+
+		ns, ok := byName[name]
+		if !ok {
+			ns = &NameServer{Name: name}
+			byName[name] = ns
+			nameServers = append(nameServers, ns)
+		}
+
+		if len(parts) < 2 {
+			continue
+		}
+
+		ip := net.ParseIP(parts[1])
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address \"%s\" of name server \"%s\"",
+				parts[1], parts[0])
+		}
+
+		if ip.To4() != nil {
+			ns.Addrs.IPv4 = append(ns.Addrs.IPv4, ip.To4())
+		} else {
+			ns.Addrs.IPv6 = append(ns.Addrs.IPv6, ip)
+		}
+	}
+
+	return nameServers, nil
+}
+
+// ---------------------------------------------------------------------------------------
+//  public members
+// ---------------------------------------------------------------------------------------
+
+// RelativeName returns the given name relative to the zone apex,
+// which is the empty string for the apex itself. If the name is
+// not within the zone false is returned.
+func (z *Zone) RelativeName(name string) (string, bool) {
+	name = dns.Fqdn(name)
+	if !dns.IsSubDomain(z.Name, name) {
+		return "", false
+	}
+
+	return strings.TrimSuffix(name[:len(name)-len(z.Name)], "."), true
+}
+
+// Fqdn returns the fully qualified name of a name relative to the zone apex.
+func (z *Zone) Fqdn(name string) string {
+	if name == "" {
+		return z.Name
+	}
+
+	return name + "." + z.Name
+}
+
+// ---------------------------------------------------------------------------------------
+//  private functions
+// ---------------------------------------------------------------------------------------
+
+// reverseZoneNames returns the names of the reverse zones covering a subnet.
+func reverseZoneNames(subnet *net.IPNet) []string {
+	ones, _ := subnet.Mask.Size()
+
+	// a label of the reverse name represents an octet or nibble
+	suffix, unitBits, units := "in-addr.arpa.", 8, []byte(subnet.IP.To4())
+	if units == nil {
+		suffix, unitBits, units = "ip6.arpa.", 4, nil
+		for _, b := range subnet.IP.To16() {
+			units = append(units, b>>4, b&0x0f)
+		}
+	}
+
+	// the subnet is extended to the next label boundary, the
+	// remaining host bits are the low bits of the last label
+	zoneUnits := (ones + unitBits - 1) / unitBits
+	count := 1 << uint(zoneUnits*unitBits-ones)
+
+	names := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		labels := make([]string, 0, zoneUnits)
+		for j := zoneUnits - 1; j >= 0; j-- {
+			unit := int(units[j])
+			if j == zoneUnits-1 {
+				unit |= i
+			}
+
+			if unitBits == 4 {
+				labels = append(labels, fmt.Sprintf("%x", unit))
+			} else {
+				labels = append(labels, fmt.Sprintf("%d", unit))
+			}
+		}
+
+		names = append(names, strings.Join(append(labels, suffix), "."))
+	}
+
+	return names
+}
+
+// parseReverseName returns the address of a reverse name relative to
+// the apex of a reverse zone. Nil is returned if the name does not
+// denote a complete address.
+func parseReverseName(z *Zone, name string) net.IP {
+	full := strings.TrimSuffix(z.Fqdn(name), ".")
+	labels := strings.Split(strings.ToLower(full), ".")
+
+	switch {
+	case strings.HasSuffix(full, "in-addr.arpa") && len(labels) == 6:
+		return net.ParseIP(fmt.Sprintf("%s.%s.%s.%s",
+			labels[3], labels[2], labels[1], labels[0]))
+
+	case strings.HasSuffix(full, "ip6.arpa") && len(labels) == 34:
+		var addr strings.Builder
+		for i := 31; i >= 0; i-- {
+			addr.WriteString(labels[i])
+			if i%4 == 0 && i > 0 {
+				addr.WriteString(":")
+			}
+		}
+		return net.ParseIP(addr.String())
+	}
+
+	return nil
+}
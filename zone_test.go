@@ -0,0 +1,91 @@
+package main
+
+// swarm-dns-sd
+// Copyright (C) 2020 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+// ---------------------------------------------------------------------------------------
+//  tests
+// ---------------------------------------------------------------------------------------
+
+func TestReverseZoneNames(t *testing.T) {
+	tests := []struct {
+		subnet string
+		names  []string
+	}{
+		{"10.0.0.0/8", []string{"10.in-addr.arpa."}},
+		{"10.1.2.0/24", []string{"2.1.10.in-addr.arpa."}},
+		{"10.1.2.0/23", []string{"2.1.10.in-addr.arpa.", "3.1.10.in-addr.arpa."}},
+		{"10.1.2.3/32", []string{"3.2.1.10.in-addr.arpa."}},
+		{"fd00:10::/64", []string{"0.0.0.0.0.0.0.0.0.1.0.0.0.0.d.f.ip6.arpa."}},
+		{"2001:db8::/30", []string{
+			"8.b.d.0.1.0.0.2.ip6.arpa.", "9.b.d.0.1.0.0.2.ip6.arpa.",
+			"a.b.d.0.1.0.0.2.ip6.arpa.", "b.b.d.0.1.0.0.2.ip6.arpa.",
+		}},
+		{"fd00::1/128", []string{
+			"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa.",
+		}},
+	}
+
+	for _, test := range tests {
+		_, subnet, err := net.ParseCIDR(test.subnet)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		names := reverseZoneNames(subnet)
+		if !reflect.DeepEqual(names, test.names) {
+			t.Errorf("%s: expected %v, got %v", test.subnet, test.names, names)
+		}
+	}
+}
+
+func TestParseReverseName(t *testing.T) {
+	tests := []struct {
+		zone string
+		name string
+		ip   string
+	}{
+		{"2.1.10.in-addr.arpa.", "3", "10.1.2.3"},
+		{"10.in-addr.arpa.", "3.2.1", "10.1.2.3"},
+		{"10.in-addr.arpa.", "2.1", ""},
+		{"3.2.1.10.in-addr.arpa.", "", "10.1.2.3"},
+		{"2.1.10.in-addr.arpa.", "", ""},
+		{"0.0.0.0.0.0.0.0.0.1.0.0.0.0.d.f.ip6.arpa.", "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0", "fd00:10::1"},
+		{"0.0.0.0.0.0.0.0.0.1.0.0.0.0.d.f.ip6.arpa.", "1.0.0.0", ""},
+		{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa.", "", "fd00::1"},
+	}
+
+	for _, test := range tests {
+		ip := parseReverseName(&Zone{Name: test.zone}, test.name)
+		if test.ip == "" {
+			if ip != nil {
+				t.Errorf("%s in %s: expected no address, got %s", test.name, test.zone, ip)
+			}
+		} else if !ip.Equal(net.ParseIP(test.ip)) {
+			t.Errorf("%s in %s: expected %s, got %s", test.name, test.zone, test.ip, ip)
+		}
+	}
+}